@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ansibleVaultCommand converts between Ansible Vault payloads and gosecret tags, for playbooks migrating from
+// one to the other.
+func ansibleVaultCommand(args []string) int {
+	subcommands := map[string]func([]string) int{
+		"import": ansibleVaultImport,
+		"render": ansibleVaultRender,
+	}
+
+	if len(args) > 0 {
+		if subcommand, ok := subcommands[args[0]]; ok {
+			return subcommand(args[1:])
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: gosecret ansible-vault import|render [options] file ...")
+	return 1
+}
+
+// ansibleVaultImport replaces the inline Ansible Vault values in files, or files that are vault payloads, with
+// gosecret tags.
+func ansibleVaultImport(args []string) int {
+	var keystore string
+	var keyname string
+	var passwordFile string
+	var inPlace bool
+	var backends backendFlags
+	flags := flag.NewFlagSet("ansible-vault import", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.StringVar(&keyname, "key", "", "key to encrypt the imported values with")
+	flags.StringVar(&passwordFile, "vault-password-file", "", "file holding the vault password; defaults to $ANSIBLE_VAULT_PASSWORD_FILE")
+	flags.BoolVar(&inPlace, "w", false, "rewrite the files instead of printing the imported file")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret ansible-vault import [options] file ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 || (flags.NArg() > 1 && !inPlace) {
+		flags.Usage()
+		return 1
+	}
+	if keyname == "" {
+		fmt.Println("A -key must be provided to encrypt the imported values")
+		return 1
+	}
+	password, err := readVaultPassword(passwordFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	for _, fileName := range flags.Args() {
+		status := rewriteFile(fileName, inPlace, func(content []byte) ([]byte, error) {
+			return gosecret.ImportAnsibleVault(content, password, keyname, keystore, filepath.Base(fileName))
+		})
+		if status != 0 {
+			return status
+		}
+	}
+	return 0
+}
+
+// ansibleVaultRender replaces the gosecret tags in YAML files with inline Ansible Vault values.
+func ansibleVaultRender(args []string) int {
+	var keystore string
+	var passwordFile string
+	var inPlace bool
+	var backends backendFlags
+	flags := flag.NewFlagSet("ansible-vault render", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.StringVar(&passwordFile, "vault-password-file", "", "file holding the vault password; defaults to $ANSIBLE_VAULT_PASSWORD_FILE")
+	flags.BoolVar(&inPlace, "w", false, "rewrite the files instead of printing the rendered file")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret ansible-vault render [options] file ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 || (flags.NArg() > 1 && !inPlace) {
+		flags.Usage()
+		return 1
+	}
+	password, err := readVaultPassword(passwordFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	for _, fileName := range flags.Args() {
+		status := rewriteFile(fileName, inPlace, func(content []byte) ([]byte, error) {
+			return gosecret.RenderAnsibleVault(content, password, keystore)
+		})
+		if status != 0 {
+			return status
+		}
+	}
+	return 0
+}
+
+// readVaultPassword reads the vault password from a file, as Ansible does, ignoring trailing white space.
+func readVaultPassword(passwordFile string) ([]byte, error) {
+	passwordFile = firstNonEmpty(passwordFile, os.Getenv("ANSIBLE_VAULT_PASSWORD_FILE"))
+	if passwordFile == "" {
+		return nil, errors.New("A -vault-password-file must be provided")
+	}
+	password, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	password = bytes.TrimRight(password, " \t\r\n")
+	if len(password) == 0 {
+		return nil, errors.New("The vault password file " + passwordFile + " is empty")
+	}
+	return password, nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"filippo.io/age"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// AgeScheme is the scheme of key names referring to data keys encrypted to age recipients.
+const AgeScheme = "age"
+
+// An AgeBackend is a KeyGenerator that protects data keys by encrypting them to age X25519 recipients, so that
+// a secret can be decrypted by anyone holding the identity of one of its recipients, without a shared keystore.
+// To encrypt with it, name the recipients as age:<recipient>[,<recipient>...].  A data key is then generated
+// and tags record it, encrypted with age, in their key name:
+//
+//	age:<Base64 age file>
+//
+// The age file's header holds a stanza for each recipient.  Decryption needs one of the backend's identities.
+type AgeBackend struct {
+	identities []age.Identity
+
+	lock      sync.Mutex
+	generated map[string]string
+	cache     keyCache
+}
+
+// NewAgeBackend returns an AgeBackend that decrypts data keys with identities, which may be empty if it is only
+// used to encrypt.
+func NewAgeBackend(identities ...age.Identity) *AgeBackend {
+	return &AgeBackend{
+		identities: identities,
+		generated:  make(map[string]string),
+		cache:      make(keyCache),
+	}
+}
+
+// DataKey returns the reference of a data key encrypted to the comma separated recipients in ref, or ref
+// itself if it already refers to a data key.
+func (a *AgeBackend) DataKey(ref string) (string, error) {
+	if !strings.HasPrefix(ref, "age1") {
+		return ref, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if dataKey, ok := a.generated[ref]; ok {
+		return dataKey, nil
+	}
+
+	var recipients []age.Recipient
+	for _, s := range strings.Split(ref, ",") {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+		if err != nil {
+			return "", err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	key := CreateKey()
+	defer Wipe(key)
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(key); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	dataKey := base64.StdEncoding.EncodeToString(buf.Bytes())
+	a.generated[ref] = dataKey
+	a.cache.put(dataKey, key)
+	return dataKey, nil
+}
+
+// UnwrapKey returns the data key ref refers to, decrypting it with the backend's identities unless it is cached.
+func (a *AgeBackend) UnwrapKey(ref string) ([]byte, error) {
+	if strings.HasPrefix(ref, "age1") {
+		return nil, fmt.Errorf("age:%s names age recipients, not a data key; it can only be used to encrypt", ref)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if key, ok := a.cache.get(ref); ok {
+		return key, nil
+	}
+
+	file, err := base64.StdEncoding.DecodeString(ref)
+	if err != nil {
+		return nil, fmt.Errorf("malformed age key reference: %v", err)
+	}
+	if len(a.identities) == 0 {
+		return nil, fmt.Errorf("an age identity is required to decrypt tags encrypted to age recipients")
+	}
+	r, err := age.Decrypt(bytes.NewReader(file), a.identities...)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	a.cache.put(ref, key)
+	return key, nil
+}
+
+// Close wipes the cached data keys.  The backend remains usable, but decrypts data keys again.
+func (a *AgeBackend) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.cache.clear()
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"filippo.io/age"
+	"strings"
+	"testing"
+)
+
+func TestAgeBackend(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eve, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterKeyBackend(AgeScheme, NewAgeBackend())
+	defer RegisterKeyBackend(AgeScheme, nil)
+	keyname := "age:" + alice.Recipient().String() + "," + bob.Recipient().String()
+	encrypted, err := EncryptTags([]byte("[gosecret|db|hunter2]"), keyname, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := FindTags(encrypted)
+	if len(tags) != 1 || !strings.HasPrefix(tags[0].KeyName, "age:YWdlLWVuY3J5cHRpb24ub3JnL3Yx") {
+		t.Fatalf("expected the tag to record an age encrypted data key, got %q", encrypted)
+	}
+
+	for _, identity := range []*age.X25519Identity{alice, bob} {
+		RegisterKeyBackend(AgeScheme, NewAgeBackend(identity))
+		if decrypted, err := DecryptTags(encrypted, ""); err != nil || string(decrypted) != "hunter2" {
+			t.Errorf("unexpected decryption %q: %v", decrypted, err)
+		}
+	}
+
+	RegisterKeyBackend(AgeScheme, NewAgeBackend(eve))
+	if _, err := tags[0].Decrypt(""); err == nil {
+		t.Error("expected decryption without a recipient's identity to fail")
+	}
+}
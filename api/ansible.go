@@ -0,0 +1,272 @@
+package api
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/yaml.v2"
+	"regexp"
+	"strings"
+)
+
+// The header of Ansible Vault payloads written by EncryptAnsibleVault.  Version 1.2 payloads, which add a
+// vault ID to the header, are encrypted in the same way and can also be decrypted.
+const ansibleVaultHeader = "$ANSIBLE_VAULT;1.1;AES256"
+
+// The start of an inline Ansible Vault value: the !vault tag and a literal block scalar indicator.
+var ansibleVaultInlineRegex = regexp.MustCompile(`!vault[ \t]+\|[-+0-9]*[ \t]*\r?\n`)
+
+// DecryptAnsibleVault decrypts an Ansible Vault payload, beginning with its $ANSIBLE_VAULT header, with the vault
+// password.  Only the AES256 cipher, which every current version of Ansible uses, is supported.
+func DecryptAnsibleVault(vault, password []byte) ([]byte, error) {
+	lines := strings.Fields(string(vault))
+	if len(lines) < 2 {
+		return nil, errors.New("not an Ansible Vault payload")
+	}
+	header := strings.Split(lines[0], ";")
+	if len(header) < 3 || header[0] != "$ANSIBLE_VAULT" {
+		return nil, errors.New("not an Ansible Vault payload")
+	}
+	if header[1] != "1.1" && header[1] != "1.2" {
+		return nil, fmt.Errorf("unsupported Ansible Vault version %s", header[1])
+	}
+	if header[2] != "AES256" {
+		return nil, fmt.Errorf("unsupported Ansible Vault cipher %s", header[2])
+	}
+
+	body, err := hex.DecodeString(strings.Join(lines[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("malformed Ansible Vault payload: %v", err)
+	}
+	parts := strings.Split(string(body), "\n")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed Ansible Vault payload")
+	}
+	var fields [3][]byte
+	for i := range fields {
+		if fields[i], err = hex.DecodeString(parts[i]); err != nil {
+			return nil, fmt.Errorf("malformed Ansible Vault payload: %v", err)
+		}
+	}
+	salt, mac, ciphertext := fields[0], fields[1], fields[2]
+
+	block, macKey, iv, err := ansibleVaultKeys(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, macKey)
+	h.Write(ciphertext)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil, errors.New("Ansible Vault HMAC mismatch; the vault password is wrong or the payload was modified")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+	padding := 0
+	if len(plaintext) > 0 {
+		padding = int(plaintext[len(plaintext)-1])
+	}
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) ||
+		!bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("malformed Ansible Vault padding")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// EncryptAnsibleVault encrypts plaintext with the vault password as an Ansible Vault 1.1 payload, as
+// ansible-vault encrypt does, with the hex encoded body wrapped at 80 columns.
+func EncryptAnsibleVault(plaintext, password []byte) ([]byte, error) {
+	salt := createRandomBytes(32)
+	block, macKey, iv, err := ansibleVaultKeys(password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, padded)
+	h := hmac.New(sha256.New, macKey)
+	h.Write(ciphertext)
+
+	body := hex.EncodeToString([]byte(hex.EncodeToString(salt) + "\n" + hex.EncodeToString(h.Sum(nil)) + "\n" +
+		hex.EncodeToString(ciphertext)))
+	var buf bytes.Buffer
+	buf.WriteString(ansibleVaultHeader)
+	for len(body) > 0 {
+		n := 80
+		if n > len(body) {
+			n = len(body)
+		}
+		buf.WriteString("\n" + body[:n])
+		body = body[n:]
+	}
+	return buf.Bytes(), nil
+}
+
+// Derive the AES-256 cipher, HMAC key and counter IV of an Ansible Vault payload from its password and salt.
+func ansibleVaultKeys(password, salt []byte) (cipher.Block, []byte, []byte, error) {
+	derived := pbkdf2.Key(password, salt, 10000, 80, sha256.New)
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return block, derived[32:64], derived[64:], nil
+}
+
+// ImportAnsibleVault converts the Ansible Vault payloads in content, decrypted with the vault password, into
+// template tags encrypted with the key named keyname.  If content is itself a vault payload, as made by
+// ansible-vault encrypt, the result is a single tag, with name as its auth data, that decrypts to the whole
+// file.  Otherwise, each inline !vault value in the YAML document is replaced by a tag whose auth data is the
+// value's key and whose plaintext is the value as a double quoted string, and everything else is left as it is.
+func ImportAnsibleVault(content, password []byte, keyname, keyroot, name string) ([]byte, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("$ANSIBLE_VAULT;")) {
+		plaintext, err := DecryptAnsibleVault(content, password)
+		if err != nil {
+			return nil, err
+		}
+		tag, err := Tag{Format: TemplateFormat, AuthData: name, Plaintext: plaintext}.Encrypt(keyname, keyroot, "")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(tag.String()), nil
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range ansibleVaultInlineRegex.FindAllIndex(content, -1) {
+		if loc[0] < last {
+			continue
+		}
+		lineStart := bytes.LastIndexByte(content[:loc[0]], '\n') + 1
+		authData := ansibleVaultKey(string(content[lineStart:loc[0]]))
+		vault, end := ansibleVaultBlock(content, loc[1])
+		plaintext, err := DecryptAnsibleVault(vault, password)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt %s: %v", authData, err)
+		}
+
+		scalar, err := jsonScalar(string(plaintext))
+		if err != nil {
+			return nil, err
+		}
+		tag, err := Tag{Format: TemplateFormat, AuthData: authData, Plaintext: scalar}.Encrypt(keyname, keyroot, "")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(content[last:loc[0]])
+		buf.WriteString(tag.String())
+		last = end
+	}
+	buf.Write(content[last:])
+	return buf.Bytes(), nil
+}
+
+// Return the key of the YAML mapping entry whose value starts on a line, given the line's text before the value,
+// or "vault" if the value is not in a mapping.
+func ansibleVaultKey(line string) string {
+	key := strings.TrimSpace(line)
+	key = strings.TrimSpace(strings.TrimPrefix(key, "-"))
+	key = strings.TrimSuffix(key, ":")
+	key = strings.Trim(key, `"'`)
+	if key == "" {
+		return "vault"
+	}
+	return key
+}
+
+// Return the text of the indented block starting at offset start in content, and the offset of its end,
+// excluding the block's final line break.
+func ansibleVaultBlock(content []byte, start int) ([]byte, int) {
+	indent := -1
+	end := start
+	for pos := start; pos < len(content); {
+		lineEnd := bytes.IndexByte(content[pos:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(content)
+		} else {
+			lineEnd += pos
+		}
+		line := content[pos:lineEnd]
+		text := bytes.TrimLeft(line, " \t")
+		lineIndent := len(line) - len(text)
+		if len(bytes.TrimSpace(text)) == 0 || lineIndent == 0 || (indent >= 0 && lineIndent < indent) {
+			break
+		}
+		if indent < 0 {
+			indent = lineIndent
+		}
+		end = lineEnd
+		pos = lineEnd + 1
+	}
+	return content[start:end], end
+}
+
+// RenderAnsibleVault replaces each tag in a YAML document, encrypted or not, with an inline Ansible Vault value
+// holding its plaintext, encrypted with the vault password, so that Ansible can use the document.  Tags must
+// make up a whole value, optionally in quotes; the quoted or unquoted YAML scalar they decrypt to is the value
+// put in the vault.  Encrypted tags are decrypted with keys from keyroot.
+func RenderAnsibleVault(content, password []byte, keyroot string) ([]byte, error) {
+	var buf bytes.Buffer
+	last := 0
+	for _, tag := range FindTags(content) {
+		if tag.Offset < last {
+			continue
+		}
+		start, end := tag.Offset, tag.Offset+tag.Length
+		lineStart := bytes.LastIndexByte(content[:start], '\n') + 1
+		lineEnd := bytes.IndexByte(content[end:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(content)
+		} else {
+			lineEnd += end
+		}
+
+		quote := ""
+		if start > lineStart && end < lineEnd && (content[start-1] == '"' || content[start-1] == '\'') &&
+			content[end] == content[start-1] {
+			quote = string(content[start-1])
+			start--
+			end++
+		}
+		before := strings.TrimSpace(string(content[lineStart:start]))
+		if !(strings.HasSuffix(before, ":") || before == "-") || len(bytes.TrimSpace(content[end:lineEnd])) > 0 {
+			return nil, fmt.Errorf("tag %q at line %d is not a whole YAML value", tag.AuthData, tag.Line)
+		}
+
+		plaintext, err := tag.DecryptSecure(keyroot)
+		if err != nil {
+			return nil, err
+		}
+		// The plaintext is read as the YAML scalar it stood for, which can only be done into a string.
+		value := plaintext.Bytes()
+		scalar := append(append([]byte(quote), value...), quote...)
+		var unquoted string
+		if err := yaml.Unmarshal(scalar, &unquoted); err == nil {
+			value = []byte(unquoted)
+		}
+		Wipe(scalar)
+		vault, err := EncryptAnsibleVault(value, password)
+		plaintext.Destroy()
+		if err != nil {
+			return nil, err
+		}
+
+		line := content[lineStart:lineEnd]
+		indent := string(line[:len(line)-len(bytes.TrimLeft(line, " "))]) + "  "
+		buf.Write(content[last:start])
+		buf.WriteString("!vault |")
+		for _, vaultLine := range strings.Split(string(vault), "\n") {
+			buf.WriteString("\n" + indent + vaultLine)
+		}
+		last = end
+	}
+	buf.Write(content[last:])
+	return buf.Bytes(), nil
+}
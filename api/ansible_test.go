@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAnsibleVault(t *testing.T) {
+	for _, plaintext := range []string{"", "hunter2", "exactly 16 bytes", strings.Repeat("long secret ", 20)} {
+		vault, err := EncryptAnsibleVault([]byte(plaintext), []byte("vaultpass"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(vault), "\n")
+		if lines[0] != "$ANSIBLE_VAULT;1.1;AES256" || len(lines[1]) != 80 {
+			t.Errorf("unexpected vault payload %s", vault)
+		}
+		decrypted, err := DecryptAnsibleVault(vault, []byte("vaultpass"))
+		if err != nil || string(decrypted) != plaintext {
+			t.Errorf("expected %q, got %q: %v", plaintext, decrypted, err)
+		}
+		if _, err := DecryptAnsibleVault(vault, []byte("wrong")); err == nil {
+			t.Error("expected decryption with the wrong password to fail")
+		}
+	}
+
+	// A version 1.2 payload differs only in naming a vault ID.
+	vault, _ := EncryptAnsibleVault([]byte("hunter2"), []byte("vaultpass"))
+	vault = bytes.Replace(vault, []byte(";1.1;AES256"), []byte(";1.2;AES256;prod"), 1)
+	if decrypted, err := DecryptAnsibleVault(vault, []byte("vaultpass")); err != nil || string(decrypted) != "hunter2" {
+		t.Errorf("unexpected decryption %q: %v", decrypted, err)
+	}
+}
+
+func TestAnsibleVaultImportRender(t *testing.T) {
+	password := []byte("vaultpass")
+	document := "db:\n  user: app\n  password: \"[gosecret|db password|hun\\\"ter2]\"\n  hosts:\n    - [gosecret|host|db1]\nport: 5432\n"
+
+	rendered, err := RenderAnsibleVault([]byte(document), password, "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(rendered, []byte("gosecret")) || bytes.Contains(rendered, []byte("hun")) ||
+		!bytes.Contains(rendered, []byte("  password: !vault |\n    $ANSIBLE_VAULT;1.1;AES256\n    ")) ||
+		!bytes.Contains(rendered, []byte("    - !vault |\n      $ANSIBLE_VAULT;1.1;AES256\n      ")) ||
+		!bytes.HasSuffix(rendered, []byte("\nport: 5432\n")) {
+		t.Errorf("unexpected rendered document %s", rendered)
+	}
+
+	imported, err := ImportAnsibleVault(rendered, password, "myteamkey-2014-09-19", "../test_keys", "vars.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(imported, []byte("  password: {{goDecrypt \"password\" ")) ||
+		!bytes.Contains(imported, []byte("    - {{goDecrypt \"vault\" ")) {
+		t.Errorf("unexpected imported document %s", imported)
+	}
+	decrypted, err := DecryptTemplateTags(imported, "../test_keys", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "db:\n  user: app\n  password: \"hun\\\"ter2\"\n  hosts:\n    - \"db1\"\nport: 5432\n"
+	if string(decrypted) != expected {
+		t.Errorf("expected %q, got %q", expected, decrypted)
+	}
+
+	if _, err := RenderAnsibleVault([]byte("url: http://[gosecret|host|db1]/\n"), password, ""); err == nil {
+		t.Error("expected a tag within a value to be refused")
+	}
+	if _, err := ImportAnsibleVault(rendered, []byte("wrong"), "myteamkey-2014-09-19", "../test_keys", ""); err == nil {
+		t.Error("expected import with the wrong password to fail")
+	}
+}
+
+func TestAnsibleVaultImportFile(t *testing.T) {
+	vault, err := EncryptAnsibleVault([]byte("user: app\npassword: hunter2\n"), []byte("vaultpass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportAnsibleVault(append(vault, '\n'), []byte("vaultpass"), "myteamkey-2014-09-19", "../test_keys", "vars.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := FindTags(imported)
+	if len(tags) != 1 || tags[0].AuthData != "vars.yml" {
+		t.Fatalf("expected a single tag for the whole file, got %s", imported)
+	}
+	decrypted, err := DecryptTemplateTags(imported, "../test_keys", "", "", nil)
+	if err != nil || string(decrypted) != "user: app\npassword: hunter2\n" {
+		t.Errorf("unexpected decryption %q: %v", decrypted, err)
+	}
+}
+
+// The vaults under test_data/ansible are the version 1.1 and 1.2 fixtures of Ansible's own vault tests, written
+// by ansible-vault with the password in test_keys/ansible-vault-password.
+func TestAnsibleVaultFixtures(t *testing.T) {
+	password, err := ioutil.ReadFile("../test_keys/ansible-vault-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	password = bytes.TrimRight(password, "\n")
+
+	for file, plaintext := range map[string]string{"file_1.1.vault": "foo\n", "file_1.2.vault": "foo bar\n"} {
+		vault, err := ioutil.ReadFile("../test_data/ansible/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted, err := DecryptAnsibleVault(vault, password); err != nil || string(decrypted) != plaintext {
+			t.Errorf("%s: expected %q, got %q: %v", file, plaintext, decrypted, err)
+		}
+		if _, err := DecryptAnsibleVault(vault, []byte("wrong")); err == nil {
+			t.Errorf("%s: expected decryption with the wrong password to fail", file)
+		}
+	}
+
+	vars, err := ioutil.ReadFile("../test_data/ansible/vars.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportAnsibleVault(vars, password, "myteamkey-2014-09-19", "../test_keys", "vars.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptTemplateTags(imported, "../test_keys", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "db:\n  user: app\n  password: \"foo\\n\"\nport: 5432\n"
+	if string(decrypted) != expected {
+		t.Errorf("expected %q, got %q", expected, decrypted)
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operations recorded in AuditEvents.
+const (
+	AuditEncrypt = "encrypt"
+	AuditDecrypt = "decrypt"
+)
+
+// The outcomes recorded in AuditEvents.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// An AuditEvent records one encryption or decryption of a tag.  It never holds the tag's plaintext or any key
+// material: data keys that are referred to directly by a key name of the form scheme:ref are identified by a
+// digest of the reference.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	KeyName   string    `json:"key"`
+	AuthData  string    `json:"auth_data"`
+	Context   string    `json:"context,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Peer      string    `json:"peer,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Host      string    `json:"host"`
+	User      string    `json:"user"`
+}
+
+// An AuditOrigin describes where the tags of an operation came from, for the AuditEvents it records.  Programs
+// that process several sources at once, such as servers, pass an AuditOrigin with each operation, using
+// Tag.DecryptSecureFrom and Tag.EncryptFrom, instead of setting a source for the whole process.
+type AuditOrigin struct {
+	// Source names the file or other source of the tags.
+	Source string
+	// Client names the client on whose behalf a server performs the operation.
+	Client string
+	// Peer identifies the process or address from which the client connected, such as "uid=1000 pid=4242".
+	Peer string
+}
+
+// An AuditSink records AuditEvents, such as to a log file or syslog.
+type AuditSink interface {
+	Record(event AuditEvent) error
+}
+
+var (
+	auditLock   sync.RWMutex
+	auditSink   AuditSink
+	auditSource string
+
+	auditIdentityOnce sync.Once
+	auditHost         string
+	auditUser         string
+)
+
+// SetAuditSink makes sink record every tag encrypted or decrypted from now on, replacing any sink previously
+// set.  A nil sink turns auditing off.  While a sink is set, an operation that cannot be recorded fails, and a
+// decrypted plaintext is discarded rather than returned unrecorded.
+func SetAuditSink(sink AuditSink) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditSink = sink
+}
+
+// SetAuditSource names the file or other source of the tags being processed, to be recorded as the Source of
+// subsequent AuditEvents.  The source is shared by the whole process, so programs processing several sources
+// concurrently should leave it empty and pass an AuditOrigin with each operation instead.
+func SetAuditSource(source string) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditSource = source
+}
+
+// Record an operation on the tag with the given key name, auth data and context, if a sink is set.  If origin
+// is nil, the source set by SetAuditSource is recorded.  Returns err if the operation failed, or otherwise an
+// error if the operation could not be recorded.
+func recordTag(origin *AuditOrigin, operation, keyname, authData, context string, err error) error {
+	auditLock.RLock()
+	sink, source := auditSink, auditSource
+	auditLock.RUnlock()
+	if sink == nil {
+		return err
+	}
+	if origin == nil {
+		origin = &AuditOrigin{Source: source}
+	}
+
+	auditIdentityOnce.Do(func() {
+		auditHost, _ = os.Hostname()
+		if u, err := user.Current(); err == nil {
+			auditUser = u.Username
+		} else {
+			auditUser = strconv.Itoa(os.Getuid())
+		}
+	})
+	event := AuditEvent{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		KeyName:   auditKeyName(keyname),
+		AuthData:  authData,
+		Context:   context,
+		Source:    origin.Source,
+		Client:    origin.Client,
+		Peer:      origin.Peer,
+		Outcome:   AuditSuccess,
+		Host:      auditHost,
+		User:      auditUser,
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Error = err.Error()
+	}
+
+	if recordErr := sink.Record(event); recordErr != nil && err == nil {
+		return fmt.Errorf("unable to record %s of tag %q in audit log: %v", operation, authData, recordErr)
+	}
+	return err
+}
+
+// Return the name to record for a key.  Key names of the form scheme:ref may hold a wrapped data key, which
+// can be long, so long references are replaced by a digest that identifies them.
+func auditKeyName(keyname string) string {
+	i := strings.IndexByte(keyname, ':')
+	if i < 0 || len(keyname)-i-1 <= 64 {
+		return keyname
+	}
+	digest := sha256.Sum256([]byte(keyname[i+1:]))
+	return keyname[:i] + ":sha256:" + hex.EncodeToString(digest[:16])
+}
+
+// An AuditLog is an AuditSink that writes each event as a line of JSON.
+type AuditLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewAuditLog returns an AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog returns an AuditLog appending to the file at path, which is created, readable only by its
+// owner, if it does not exist.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(file), nil
+}
+
+// Record writes event as a line of JSON, in a single write so that lines from several processes appending to
+// the same file are not interleaved.
+func (l *AuditLog) Record(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the writer of the log, if it is an io.Closer.
+func (l *AuditLog) Close() error {
+	if closer, ok := l.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package api
+
+import (
+	"errors"
+)
+
+// Syslog is not available on Windows or Plan 9.
+func NewSyslogAuditSink(tag string) (*AuditLog, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package api
+
+import (
+	"log/syslog"
+)
+
+// NewSyslogAuditSink returns an AuditLog writing each event as a line of JSON to the local syslog daemon, with
+// the given tag, at the authpriv facility.
+func NewSyslogAuditSink(tag string) (*AuditLog, error) {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(w), nil
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type failingSink struct{}
+
+func (failingSink) Record(event AuditEvent) error {
+	return errors.New("disk full")
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	SetAuditSink(NewAuditLog(&buf))
+	defer SetAuditSink(nil)
+	SetAuditSource("config.json")
+	defer SetAuditSource("")
+
+	encrypted, err := EncryptTags([]byte("[gosecret|db password|hunter2]"), "myteamkey-2014-09-19", "../test_keys", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := FindTags(encrypted)[0]
+	bound, err := Tag{Format: TemplateFormat, AuthData: "token", Plaintext: []byte("s3cret")}.Encrypt("myteamkey-2014-09-19", "../test_keys", "doc#0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptTags(encrypted, "../test_keys"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.Decrypt("../test_keys"); err != nil {
+		t.Fatal(err)
+	}
+	tag.AuthData = "tampered"
+	if _, err := tag.Decrypt("../test_keys"); err == nil {
+		t.Fatal("expected decryption with the wrong auth data to fail")
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte("hunter2")) || bytes.Contains(buf.Bytes(), []byte("s3cret")) {
+		t.Errorf("audit log contains plaintext: %s", buf.Bytes())
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := []AuditEvent{
+		{Operation: AuditEncrypt, AuthData: "db password", Outcome: AuditSuccess},
+		{Operation: AuditEncrypt, AuthData: "token", Context: "doc#0", Outcome: AuditSuccess},
+		{Operation: AuditDecrypt, AuthData: "db password", Outcome: AuditSuccess},
+		{Operation: AuditDecrypt, AuthData: "token", Context: "doc#0", Outcome: AuditSuccess},
+		{Operation: AuditDecrypt, AuthData: "tampered", Outcome: AuditFailure},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d events, got %s", len(expected), buf.Bytes())
+	}
+	for i, line := range lines {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		e := expected[i]
+		if event.Operation != e.Operation || event.AuthData != e.AuthData || event.Context != e.Context ||
+			event.Outcome != e.Outcome || (event.Outcome == AuditFailure) != (event.Error != "") ||
+			event.KeyName != "myteamkey-2014-09-19" || event.Source != "config.json" || event.User == "" ||
+			event.Time.IsZero() {
+			t.Errorf("unexpected event %s", line)
+		}
+	}
+}
+
+func TestAuditSinkFailure(t *testing.T) {
+	tag, err := Tag{Format: TemplateFormat, AuthData: "token", Plaintext: []byte("s3cret")}.Encrypt("myteamkey-2014-09-19", "../test_keys", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := EncryptTags([]byte("password: [gosecret|db password|hunter2]"), "myteamkey-2014-09-19", "../test_keys", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAuditSink(failingSink{})
+	defer SetAuditSink(nil)
+
+	if output, err := EncryptTags([]byte("password: [gosecret|db password|hunter2]"), "myteamkey-2014-09-19", "../test_keys", false); err == nil {
+		t.Errorf("expected legacy encryption that cannot be recorded to fail, got %q", output)
+	}
+	if output, err := EncryptTags(legacy, "myteamkey-2014-09-19", "../test_keys", true); err == nil {
+		t.Errorf("expected legacy rotation that cannot be recorded to fail, got %q", output)
+	}
+	if output, err := DecryptTags(legacy, "../test_keys"); err == nil {
+		t.Errorf("expected legacy decryption that cannot be recorded to fail, got %q", output)
+	}
+	if plaintext, err := tag.Decrypt("../test_keys"); err == nil || plaintext != nil {
+		t.Errorf("expected decryption that cannot be recorded to fail, got %q", plaintext)
+	}
+	if _, err := (Tag{Format: TemplateFormat, AuthData: "a", Plaintext: []byte("b")}).Encrypt("myteamkey-2014-09-19", "../test_keys", ""); err == nil {
+		t.Error("expected encryption that cannot be recorded to fail")
+	}
+}
+
+func TestAuditKeyName(t *testing.T) {
+	if name := auditKeyName("myteamkey-2014-09-19"); name != "myteamkey-2014-09-19" {
+		t.Errorf("unexpected key name %s", name)
+	}
+	if name := auditKeyName("transit:prod"); name != "transit:prod" {
+		t.Errorf("unexpected key name %s", name)
+	}
+	name := auditKeyName("age:" + strings.Repeat("A", 200))
+	if !strings.HasPrefix(name, "age:sha256:") || len(name) != len("age:sha256:")+32 {
+		t.Errorf("unexpected key name %s", name)
+	}
+}
+
+func TestAuditOrigin(t *testing.T) {
+	var buf bytes.Buffer
+	SetAuditSink(NewAuditLog(&buf))
+	defer SetAuditSink(nil)
+	SetAuditSource("process-wide")
+	defer SetAuditSource("")
+
+	origin := AuditOrigin{Source: "request", Client: "app", Peer: "uid=1000 pid=4242"}
+	tag, err := Tag{Format: TemplateFormat, AuthData: "token", Plaintext: []byte("s3cret")}.EncryptFrom("myteamkey-2014-09-19", "../test_keys", "", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := tag.DecryptSecureFrom("../test_keys", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext.Destroy()
+	if _, err := tag.Decrypt("../test_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 events, got %s", buf.Bytes())
+	}
+	for i, line := range lines {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		expected := origin
+		if i == 2 {
+			expected = AuditOrigin{Source: "process-wide"}
+		}
+		if event.Source != expected.Source || event.Client != expected.Client || event.Peer != expected.Peer {
+			t.Errorf("expected origin %+v, got event %s", expected, line)
+		}
+	}
+}
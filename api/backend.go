@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A KeyBackend holds the master keys that protect data keys kept outside the keystore, such as in a KMS.  A key
+// file in the keystore may hold, instead of a Base64 encoded key, a reference of the form scheme:ref, where
+// scheme names a registered KeyBackend and ref identifies the wrapped data key to it.  Reading the key unwraps
+// it with the backend, so such keys can be used wherever a keystore key can.  A key name of the form
+// scheme:ref refers to a data key directly, without a key file.
+type KeyBackend interface {
+	// UnwrapKey returns the data key identified by ref.  The caller owns the returned slice and should Wipe it
+	// once done with it.
+	UnwrapKey(ref string) ([]byte, error)
+}
+
+// A KeyGenerator is a KeyBackend that can also create data keys, so that a tag can be encrypted with a key
+// name of the form scheme:master, naming a master key held by the backend.  The data key's reference, with
+// its scheme, is recorded as the tag's key name in place of the master key name.
+type KeyGenerator interface {
+	KeyBackend
+	// DataKey returns the reference of a data key protected by the master key ref names.  If ref already
+	// refers to a data key, it is returned unchanged.
+	DataKey(ref string) (string, error)
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = make(map[string]KeyBackend)
+)
+
+// RegisterKeyBackend makes backend responsible for key files holding references with the given scheme,
+// replacing any backend previously registered for it.  A nil backend unregisters the scheme.  A replaced
+// backend that caches keys is closed, wiping the keys.
+func RegisterKeyBackend(scheme string, backend KeyBackend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if old, ok := backends[scheme].(keyCloser); ok {
+		if current, _ := backend.(keyCloser); current != old {
+			old.Close()
+		}
+	}
+	if backend == nil {
+		delete(backends, scheme)
+	} else {
+		backends[scheme] = backend
+	}
+}
+
+// CloseKeyBackends unregisters every key backend, closing those that cache keys so that the keys are wiped.
+func CloseKeyBackends() {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	for scheme, backend := range backends {
+		if closer, ok := backend.(keyCloser); ok {
+			closer.Close()
+		}
+		delete(backends, scheme)
+	}
+}
+
+// A keyCloser is a KeyBackend that caches keys until it is closed.
+type keyCloser interface {
+	Close()
+}
+
+// A keyCache holds the data keys a backend has unwrapped or generated, keyed by reference, in SecureBuffers.
+// Backends guard their caches with their own locks.
+type keyCache map[string]*SecureBuffer
+
+// Return a copy of the key cached for ref, which the caller owns, if there is one.
+func (c keyCache) get(ref string) ([]byte, bool) {
+	key, ok := c[ref]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, key.Bytes()...), true
+}
+
+// Cache a copy of key for ref.
+func (c keyCache) put(ref string, key []byte) {
+	c[ref].Destroy()
+	c[ref] = NewSecureBufferFrom(key)
+}
+
+// Destroy every cached key, emptying the cache.
+func (c keyCache) clear() {
+	for ref, key := range c {
+		key.Destroy()
+		delete(c, ref)
+	}
+}
+
+// Return the backend responsible for a key name or key file reference of the form scheme:ref, if any.
+func backendFor(name string) (KeyBackend, string, string, bool) {
+	i := strings.IndexByte(name, ':')
+	if i < 0 {
+		return nil, "", "", false
+	}
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	backend, ok := backends[name[:i]]
+	return backend, name[:i], name[i+1:], ok
+}
+
+// DataKeyName returns the key name to record in tags encrypted with the key named keyname.  For a key name of
+// the form scheme:master whose backend is a KeyGenerator, this refers to a data key protected by the master
+// key; any other key name is returned unchanged.
+func DataKeyName(keyname string) (string, error) {
+	backend, scheme, ref, ok := backendFor(keyname)
+	if !ok {
+		return keyname, nil
+	}
+	generator, ok := backend.(KeyGenerator)
+	if !ok {
+		return keyname, nil
+	}
+	ref, err := generator.DataKey(ref)
+	if err != nil {
+		return "", err
+	}
+	return scheme + ":" + ref, nil
+}
+
+// Return the key a key file holds, unwrapping it with a backend if the file holds a reference.
+func keyFromFile(keypath string, file []byte) (*SecureBuffer, error) {
+	file = bytes.TrimSpace(file)
+	i := bytes.IndexByte(file, ':')
+	if i < 0 {
+		// Base64 never contains ':', so this is a key.
+		key := NewSecureBuffer(base64.StdEncoding.DecodedLen(len(file)))
+		n, err := base64.StdEncoding.Decode(key.Bytes(), file)
+		if err != nil {
+			key.Destroy()
+			return nil, err
+		}
+		key.truncate(n)
+		return key, nil
+	}
+
+	backend, _, ref, ok := backendFor(string(file))
+	if !ok {
+		return nil, fmt.Errorf("key file %s refers to the %s key backend, which is not configured", keypath, file[:i])
+	}
+	key, err := backend.UnwrapKey(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+	return NewSecureBufferFrom(key), nil
+}
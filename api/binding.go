@@ -0,0 +1,190 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Binding returns the context to which the tag at a given position in a document is bound.  Tags are
+// numbered from 0 in the order in which they appear, separately for legacy and template tags.  Legacy tags are
+// numbered among every [gosecret|...] block, including malformed blocks that are not tags; see TagIndexes.
+//
+// A bound tag includes its context in the additional authenticated data, alongside the auth data string, and
+// records it as an extra trailing field:
+//
+//	[gosecret|authtext|ciphertext|initvector|keyname|context]
+//	{{goDecrypt "authtext" "ciphertext" "initvector" "keyname" "context"}}
+//
+// The recorded context is informational; on decryption the context is always recomputed from the caller's
+// Binding, so a tag copied into another document or another position in the same document fails to
+// authenticate.
+type Binding func(index int) string
+
+// DocumentBinding binds each tag to a logical document name and the tag's position within the document.
+// The document name must be the same when encrypting and decrypting, such as a path relative to a
+// repository root, and must not contain '|' or ']'; see CheckDocumentName.  Tags are numbered in the order
+// in which they appear in the document, separately for each format, even in documents rendered as templates.
+func DocumentBinding(document string) Binding {
+	return func(index int) string {
+		return document + "#" + strconv.Itoa(index)
+	}
+}
+
+// TagIndexes returns the position a Binding is given for each of tags, as found in content by FindTags or
+// FindTagsDelims, keyed by the tag's offset.  Template tags are numbered among the template tags, and legacy
+// tags among every [gosecret|...] block in content, as EncryptTags and DecryptTags number them.
+func TagIndexes(content []byte, tags []Tag) map[int]int {
+	legacy := make(map[int]int)
+	for i, loc := range gosecretRegex.FindAllIndex(content, -1) {
+		legacy[loc[0]] = i
+	}
+
+	indexes := make(map[int]int, len(tags))
+	template := 0
+	for _, tag := range tags {
+		if tag.Format == LegacyFormat {
+			indexes[tag.Offset] = legacy[tag.Offset]
+		} else {
+			indexes[tag.Offset] = template
+			template++
+		}
+	}
+	return indexes
+}
+
+// CheckDocumentName returns an error if document cannot be used with DocumentBinding.  Legacy tags record their
+// context between '|' and ']', so a name containing either would corrupt them; tags are never encrypted with
+// such a context.
+func CheckDocumentName(document string) error {
+	return checkContext(document)
+}
+
+// Check that a tag may be bound to context.
+func checkContext(context string) error {
+	if strings.ContainsAny(context, "|]") {
+		return fmt.Errorf("context %q must not contain '|' or ']'", context)
+	}
+	return nil
+}
+
+// Compute the additional authenticated data for a tag bound to context.
+func boundAuthData(authData []byte, context string) []byte {
+	ad := make([]byte, 0, len(authData)+len(context)+18)
+	ad = append(ad, authData...)
+	ad = append(ad, "\x00gosecret-context\x00"...)
+	return append(ad, context...)
+}
+
+// Split additional authenticated data computed by boundAuthData into the auth data string and the context.
+func splitBoundAuthData(ad []byte) (string, string) {
+	if i := bytes.Index(ad, []byte("\x00gosecret-context\x00")); i >= 0 {
+		return string(ad[:i]), string(ad[i+18:])
+	}
+	return string(ad), ""
+}
+
+// Check that a tag recording the context recorded may be decrypted where the context expected is required.
+// Bound tags cannot be decrypted without an expected context, and when a context is expected every tag must
+// be bound to it.
+func checkBinding(authData, recorded, expected string) error {
+	if expected == "" && recorded != "" {
+		return fmt.Errorf("tag %q is bound to context %q; a document context is required to decrypt it", authData, recorded)
+	}
+	if expected != "" && recorded == "" {
+		return fmt.Errorf("tag %q is not bound to a context, but context %q is required", authData, expected)
+	}
+	if recorded != expected {
+		return fmt.Errorf("tag %q is bound to context %q but was found at %q", authData, recorded, expected)
+	}
+	return nil
+}
+
+// EncryptTagsBound behaves like EncryptTags, but binds every tag it encrypts to the context returned by binding
+// for the tag's position.  When rotate is true, already encrypted tags are also rebound to their current position.
+func EncryptTagsBound(content []byte, keyname, keyroot string, rotate bool, binding Binding) ([]byte, error) {
+	return encryptTags(content, keyname, keyroot, rotate, binding)
+}
+
+// DecryptTagsBound behaves like DecryptTags, but requires every encrypted tag to be bound to the context returned
+// by binding for the tag's position.  An error is returned if any tag is unbound or bound to another context.
+func DecryptTagsBound(content []byte, keyroot string, binding Binding) ([]byte, error) {
+	return decryptTags(content, keyroot, binding, nil)
+}
+
+// ParseBoundEncryptionTag behaves like ParseEncrytionTag, but binds the resulting tag to context.
+func ParseBoundEncryptionTag(keystore, context string, s ...string) (DecryptionTag, error) {
+	if len(s) != 3 {
+		return DecryptionTag{}, fmt.Errorf("expected 3 arguments, got %d", len(s))
+	}
+	if err := checkContext(context); err != nil {
+		return DecryptionTag{}, err
+	}
+
+	keyname, err := DataKeyName(s[2])
+	if err != nil {
+		return DecryptionTag{}, err
+	}
+
+	et := EncryptionTag{
+		boundAuthData([]byte(s[0]), context),
+		[]byte(s[1]),
+		keyname,
+	}
+
+	iv := createIV()
+	cipherText, err := et.EncryptTag(keystore, iv)
+	if err != nil {
+		return DecryptionTag{}, err
+	}
+
+	return DecryptionTag{[]byte(s[0]), cipherText, iv, keyname}, nil
+}
+
+// ParseBoundDecryptionTag behaves like ParseDecryptionTag, but expects a fifth argument recording the context
+// to which the tag is bound and decrypts the tag only if it is bound to context.  If context is empty, only
+// unbound tags are accepted.
+func ParseBoundDecryptionTag(keystore, context string, s ...string) (string, error) {
+	plaintext, err := ParseBoundDecryptionTagSecure(keystore, context, s...)
+	if err != nil {
+		return "", err
+	}
+	defer plaintext.Destroy()
+
+	return string(plaintext.Bytes()), nil
+}
+
+// ParseBoundDecryptionTagSecure behaves like ParseBoundDecryptionTag, but returns the plaintext in a
+// SecureBuffer, which the caller must Destroy, instead of a string.
+func ParseBoundDecryptionTagSecure(keystore, context string, s ...string) (*SecureBuffer, error) {
+	if len(s) != 4 && len(s) != 5 {
+		return nil, fmt.Errorf("expected 4 or 5 arguments, got %d", len(s))
+	}
+
+	recorded := ""
+	if len(s) == 5 {
+		recorded = s[4]
+	}
+	if err := checkBinding(s[0], recorded, context); err != nil {
+		return nil, err
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(s[1])
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.StdEncoding.DecodeString(s[2])
+	if err != nil {
+		return nil, err
+	}
+
+	ad := []byte(s[0])
+	if context != "" {
+		ad = boundAuthData(ad, context)
+	}
+	dt := DecryptionTag{ad, ct, iv, s[3]}
+
+	return dt.DecryptTagSecure(keystore)
+}
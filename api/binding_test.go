@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestBoundRoundTrip(t *testing.T) {
+	content := []byte("user: [gosecret|db user|admin]\npassword: [gosecret|db password|hunter2]\n")
+
+	encrypted, err := EncryptTagsBound(content, "myteamkey-2014-09-19", "../test_keys", false, DocumentBinding("prod/db.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(encrypted), "|myteamkey-2014-09-19|prod/db.yml#1]") {
+		t.Errorf("expected context to be recorded in %q", encrypted)
+	}
+
+	decrypted, err := DecryptTagsBound(encrypted, "../test_keys", DocumentBinding("prod/db.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte("user: admin\npassword: hunter2\n")) {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+
+	if _, err := DecryptTags(encrypted, "../test_keys"); err == nil {
+		t.Error("expected bound tags to require a context")
+	}
+}
+
+func TestTransplantedTagFails(t *testing.T) {
+	content := []byte("user: [gosecret|db password|low]\npassword: [gosecret|db password|high]\n")
+
+	encrypted, err := EncryptTagsBound(content, "myteamkey-2014-09-19", "../test_keys", false, DocumentBinding("db.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the two tags, keeping the recorded contexts, so that the low privilege secret is read as the
+	// high privilege one.
+	tags := FindTags(encrypted)
+	first := string(encrypted[tags[0].Offset : tags[0].Offset+tags[0].Length])
+	second := string(encrypted[tags[1].Offset : tags[1].Offset+tags[1].Length])
+	swapped := []byte("user: " + second + "\npassword: " + first + "\n")
+
+	if _, err := DecryptTagsBound(swapped, "../test_keys", DocumentBinding("db.yml")); err == nil {
+		t.Error("expected swapped tags to fail")
+	}
+
+	// Rewrite the recorded contexts too; authentication must still fail.
+	forged := strings.Replace(string(swapped), "db.yml#1]", "db.yml#x]", 1)
+	forged = strings.Replace(forged, "db.yml#0]", "db.yml#1]", 1)
+	forged = strings.Replace(forged, "db.yml#x]", "db.yml#0]", 1)
+	decrypted, err := DecryptTagsBound([]byte(forged), "../test_keys", DocumentBinding("db.yml"))
+	if err == nil && strings.Contains(string(decrypted), "password: low") {
+		t.Error("forged contexts decrypted a transplanted tag")
+	}
+
+	if _, err := DecryptTagsBound(encrypted, "../test_keys", DocumentBinding("other.yml")); err == nil {
+		t.Error("expected tags to fail in another document")
+	}
+}
+
+func TestTagIndexesMalformed(t *testing.T) {
+	// The first block has too few fields to be a tag, but legacy tags are still numbered after it.
+	content := []byte("[gosecret|a|b|c] [gosecret|db password|hunter2]")
+	binding := DocumentBinding("db.yml")
+
+	encrypted, err := EncryptTagsBound(content, "myteamkey-2014-09-19", "../test_keys", false, binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := FindTags(encrypted)
+	if len(tags) != 1 || TagIndexes(encrypted, tags)[tags[0].Offset] != 1 {
+		t.Fatalf("expected the tag to be numbered 1 in %q", encrypted)
+	}
+
+	rotated, err := RotateTags(encrypted, "myteamkey-2014-09-19", "../test_keys", "", "", binding, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptTagsBound(rotated, "../test_keys", binding)
+	if err != nil || string(decrypted) != "[gosecret|a|b|c] hunter2" {
+		t.Errorf("expected a rotated tag to keep its position, got %q: %v", decrypted, err)
+	}
+}
+
+func TestParseBoundTags(t *testing.T) {
+	keystore := "../test_keys"
+
+	dt, err := ParseBoundEncryptionTag(keystore, "db.yml#0", "MySql Password", "kadjf454nkklz", "myteamkey-2014-09-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{
+		string(dt.AuthData),
+		base64.StdEncoding.EncodeToString(dt.CipherText),
+		base64.StdEncoding.EncodeToString(dt.InitVector),
+		dt.KeyName,
+		"db.yml#0",
+	}
+
+	plaintext, err := ParseBoundDecryptionTag(keystore, "db.yml#0", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "kadjf454nkklz" {
+		t.Error("Decrypt failed")
+	}
+
+	if _, err := ParseBoundDecryptionTag(keystore, "db.yml#1", args...); err == nil {
+		t.Error("expected tag at another position to fail")
+	}
+	if _, err := ParseDecryptionTag(keystore, args...); err == nil {
+		t.Error("expected bound tag to require a context")
+	}
+}
+
+func TestCheckDocumentName(t *testing.T) {
+	for _, name := range []string{"a|b", "a]b"} {
+		if err := CheckDocumentName(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+		if _, err := EncryptTagsBound([]byte("[gosecret|db|one]"), "myteamkey-2014-09-19", "../test_keys", false, DocumentBinding(name)); err == nil {
+			t.Errorf("expected legacy tags bound to %q to be refused", name)
+		}
+		if _, err := (Tag{Format: LegacyFormat, AuthData: "db", Plaintext: []byte("one")}).Encrypt("myteamkey-2014-09-19", "../test_keys", name+"#0"); err == nil {
+			t.Errorf("expected a tag bound to %q to be refused", name)
+		}
+	}
+	if err := CheckDocumentName("prod/db.yml"); err != nil {
+		t.Error(err)
+	}
+}
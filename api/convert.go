@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConvertTags rewrites every tag in content into the given format, leaving the rest of content unchanged.
+// Encrypted tags keep their ciphertext, initialization vector, key name and context, so nothing is decrypted
+// or re-encrypted and no key is required.  Template tags are read and written with the given delimiters, or
+// {{ }} if they are empty.
+//
+// Unencrypted legacy tags do not name a key, so converting them to template tags requires keyname, which
+// they are to be encrypted with; converting unencrypted template tags to legacy tags drops their key name.
+// Legacy tags cannot hold fields containing '|' or ']', and cannot trim white space like template tags with
+// trim markers, so such tags cannot be converted to legacy tags.  Because a Binding numbers tags separately
+// for each format, as TagIndexes does, a document with bound tags can only be converted if the position of
+// each bound tag among the tags of its format is unchanged.
+func ConvertTags(content []byte, to TagFormat, keyname, left, right string) ([]byte, error) {
+	// Legacy tags inside the arguments of a template tag are converted along with the template tag.
+	var tags []Tag
+	found := FindTagsDelims(content, left, right)
+	last := 0
+	for _, tag := range found {
+		if tag.Offset >= last {
+			tags = append(tags, tag)
+			last = tag.Offset + tag.Length
+		}
+	}
+	indexes := TagIndexes(content, tags)
+
+	// Malformed legacy blocks are left as they are, but are numbered along with legacy tags.
+	wellFormed := make(map[int]bool, len(found))
+	for _, tag := range found {
+		wellFormed[tag.Offset] = true
+	}
+	var malformed []int
+	for _, loc := range gosecretRegex.FindAllIndex(content, -1) {
+		if !wellFormed[loc[0]] {
+			malformed = append(malformed, loc[0])
+		}
+	}
+
+	position, skipped := 0, 0
+	return ReplaceTags(content, tags, func(tag Tag) ([]byte, error) {
+		index := position
+		position++
+		if to == LegacyFormat {
+			for skipped < len(malformed) && malformed[skipped] < tag.Offset {
+				skipped++
+			}
+			index += skipped
+		}
+
+		if tag.Context != "" && indexes[tag.Offset] != index {
+			return nil, fmt.Errorf("tag %q is bound to its position among %s tags, which conversion would change", tag.AuthData, tag.Format)
+		}
+		if tag.Format == to {
+			return content[tag.Offset : tag.Offset+tag.Length], nil
+		}
+
+		converted := tag
+		converted.Format = to
+		if to == TemplateFormat {
+			if !tag.Encrypted {
+				if keyname == "" {
+					return nil, fmt.Errorf("tag %q does not name a key; a key name is required to convert it", tag.AuthData)
+				}
+				converted.KeyName = keyname
+			}
+			converted.LeftDelim, converted.RightDelim = left, right
+			return []byte(converted.String()), nil
+		}
+
+		if tag.TrimLeft || tag.TrimRight {
+			return nil, fmt.Errorf("tag %q trims white space, which legacy tags cannot", tag.AuthData)
+		}
+		for _, field := range []string{tag.AuthData, string(tag.Plaintext), tag.KeyName, tag.Context} {
+			if strings.ContainsAny(field, "|]") {
+				return nil, fmt.Errorf("tag %q has a field containing '|' or ']', which legacy tags cannot hold", tag.AuthData)
+			}
+		}
+		if !tag.Encrypted {
+			converted.KeyName = ""
+		}
+		converted.LeftDelim, converted.RightDelim = "", ""
+		return []byte(converted.String()), nil
+	})
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestConvertTagsRoundTrip(t *testing.T) {
+	file, err := ioutil.ReadFile(path.Join("../test_data/template", "encrypted_hybrid.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template, err := ConvertTags(file, TemplateFormat, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := ConvertTags(template, LegacyFormat, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, converted := range []struct {
+		content []byte
+		format  TagFormat
+	}{{template, TemplateFormat}, {legacy, LegacyFormat}} {
+		tags := FindTags(converted.content)
+		if len(tags) != 2 || tags[0].Format != converted.format || tags[1].Format != converted.format {
+			t.Fatalf("expected 2 %s tags in %q", converted.format, converted.content)
+		}
+		for _, tag := range tags {
+			plaintext, err := tag.Decrypt("../test_keys")
+			if err != nil || string(plaintext) != "kadjf454nkklz" {
+				t.Errorf("unable to decrypt converted tag %+v: %v", tag, err)
+			}
+		}
+	}
+}
+
+func TestConvertTagsErrors(t *testing.T) {
+	if _, err := ConvertTags([]byte("[gosecret|auth|text]"), TemplateFormat, "", "", ""); err == nil {
+		t.Error("expected an unencrypted legacy tag to require a key name")
+	}
+	converted, err := ConvertTags([]byte("[gosecret|auth|text]"), TemplateFormat, "key", "[[", "]]")
+	if err != nil || string(converted) != `[[goEncrypt "auth" "text" "key"]]` {
+		t.Errorf("unexpected conversion %q: %v", converted, err)
+	}
+	if _, err := ConvertTags([]byte(`{{goEncrypt "a|b" "text" "key"}}`), LegacyFormat, "", "", ""); err == nil {
+		t.Error("expected a field containing '|' to be rejected")
+	}
+
+	bound, err := EncryptTagsBound([]byte("[gosecret|one|1] [gosecret|two|2]"), "myteamkey-2014-09-19", "../test_keys", false, DocumentBinding("doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConvertTags(bound, TemplateFormat, "", "", ""); err != nil {
+		t.Errorf("expected a document whose tags keep their positions to convert: %v", err)
+	}
+	if _, err := ConvertTags(append([]byte(`{{goEncrypt "x" "y" "key"}} `), bound...), LegacyFormat, "", "", ""); err == nil {
+		t.Error("expected conversion that moves bound tags to be rejected")
+	}
+}
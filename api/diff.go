@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// SecretChange describes how a secret differs between two versions of a document.
+type SecretChange int
+
+const (
+	SecretUnchanged SecretChange = iota
+	SecretAdded
+	SecretRemoved
+	SecretChanged
+)
+
+func (c SecretChange) String() string {
+	switch c {
+	case SecretAdded:
+		return "added"
+	case SecretRemoved:
+		return "removed"
+	case SecretChanged:
+		return "changed"
+	}
+	return "unchanged"
+}
+
+// A SecretDiff reports the change to a single secret, identified by its auth data.  If several tags in a
+// document share the same auth data, they are paired up in the order in which they appear.  OldKeyName and
+// NewKeyName are empty for unencrypted tags and for secrets that do not exist in that version.
+type SecretDiff struct {
+	AuthData   string
+	Change     SecretChange
+	OldKeyName string
+	NewKeyName string
+}
+
+// A LineDiff is a line of non-secret text that was removed from (Op '-') or added to (Op '+') a document.
+// Every tag in the line is replaced by a <secret: auth data> placeholder, so no plaintext or ciphertext is
+// included; OldLine and NewLine are 1-based and 0 where the line does not exist in that version.
+type LineDiff struct {
+	Op      byte
+	OldLine int
+	NewLine int
+	Text    string
+}
+
+// A DocumentDiff is the semantic difference between two versions of a document, as computed by DiffDocuments.
+type DocumentDiff struct {
+	Secrets []SecretDiff
+	Text    []LineDiff
+}
+
+// Changed reports whether the two documents differ in any secret or in any non-secret text.
+func (d DocumentDiff) Changed() bool {
+	for _, s := range d.Secrets {
+		if s.Change != SecretUnchanged {
+			return true
+		}
+	}
+	return len(d.Text) > 0
+}
+
+// DiffDocuments compares two versions of a document tag by tag.  Encrypted tags are decrypted with keys
+// from keyroot so that secrets which were merely re-encrypted, with a new initialization vector or key,
+// compare as unchanged.  Plaintext is used only for comparison and is never included in the result.
+func DiffDocuments(old, new []byte, keyroot string) (DocumentDiff, error) {
+	oldTags := FindTags(old)
+	newTags := FindTags(new)
+
+	oldSecrets, err := tagPlaintexts(oldTags, keyroot)
+	if err != nil {
+		return DocumentDiff{}, err
+	}
+	defer destroyAll(oldSecrets)
+	newSecrets, err := tagPlaintexts(newTags, keyroot)
+	if err != nil {
+		return DocumentDiff{}, err
+	}
+	defer destroyAll(newSecrets)
+
+	var diff DocumentDiff
+
+	// Pair tags with the same auth data in order of appearance.
+	used := make([]bool, len(newTags))
+	for i, ot := range oldTags {
+		match := -1
+		for j, nt := range newTags {
+			if !used[j] && nt.AuthData == ot.AuthData {
+				match = j
+				break
+			}
+		}
+		if match < 0 {
+			diff.Secrets = append(diff.Secrets, SecretDiff{ot.AuthData, SecretRemoved, ot.KeyName, ""})
+			continue
+		}
+		used[match] = true
+		change := SecretUnchanged
+		if !bytes.Equal(oldSecrets[i].Bytes(), newSecrets[match].Bytes()) {
+			change = SecretChanged
+		}
+		diff.Secrets = append(diff.Secrets, SecretDiff{ot.AuthData, change, ot.KeyName, newTags[match].KeyName})
+	}
+	for j, nt := range newTags {
+		if !used[j] {
+			diff.Secrets = append(diff.Secrets, SecretDiff{nt.AuthData, SecretAdded, "", nt.KeyName})
+		}
+	}
+
+	diff.Text = diffLines(redactedLines(old, oldTags), redactedLines(new, newTags))
+
+	return diff, nil
+}
+
+// Return the plaintext of each tag, decrypting encrypted tags, in SecureBuffers that the caller must destroy.
+func tagPlaintexts(tags []Tag, keyroot string) ([]*SecureBuffer, error) {
+	plaintexts := make([]*SecureBuffer, len(tags))
+	for i, tag := range tags {
+		plaintext, err := tag.DecryptSecure(keyroot)
+		if err != nil {
+			destroyAll(plaintexts)
+			return nil, fmt.Errorf("unable to decrypt tag %q at line %d: %v", tag.AuthData, tag.Line, err)
+		}
+		plaintexts[i] = plaintext
+	}
+	return plaintexts, nil
+}
+
+// Split content into lines with every tag replaced by a placeholder naming its auth data.
+func redactedLines(content []byte, tags []Tag) []string {
+	redacted, _ := ReplaceTags(content, tags, func(tag Tag) ([]byte, error) {
+		return []byte(placeholder(tag)), nil
+	})
+	return strings.SplitAfter(string(redacted), "\n")
+}
+
+// Compute a minimal line diff between a and b using the longest common subsequence.
+func diffLines(a, b []string) []LineDiff {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diffs []LineDiff
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diffs = append(diffs, LineDiff{'-', i + 1, 0, strings.TrimSuffix(a[i], "\n")})
+			i++
+		default:
+			diffs = append(diffs, LineDiff{'+', 0, j + 1, strings.TrimSuffix(b[j], "\n")})
+			j++
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDiffReencryptedFile(t *testing.T) {
+	file, err := ioutil.ReadFile(path.Join("../test_data", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := ioutil.ReadFile(path.Join("../test_data", "config_enc.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	new, err := EncryptTags(file, "myteamkey-2014-09-19", "../test_keys", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffDocuments(old, new, "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff.Changed() {
+		t.Errorf("expected re-encrypted file to be unchanged, got %+v", diff)
+	}
+}
+
+func TestDiffChangedSecretsAndText(t *testing.T) {
+	old := []byte("host: db1\npassword: [gosecret|db password|hunter2]\nuser: [gosecret|db user|admin]\n")
+	new := []byte("host: db2\npassword: [gosecret|db password|hunter3]\ntoken: [gosecret|api token|abc]\n")
+
+	encrypted, err := EncryptTags(new, "myteamkey-2014-09-19", "../test_keys", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffDocuments(old, encrypted, "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := map[string]SecretChange{}
+	for _, s := range diff.Secrets {
+		changes[s.AuthData] = s.Change
+	}
+	expected := map[string]SecretChange{
+		"db password": SecretChanged,
+		"db user":     SecretRemoved,
+		"api token":   SecretAdded,
+	}
+	for auth, change := range expected {
+		if changes[auth] != change {
+			t.Errorf("expected %q to be %s, got %s", auth, change, changes[auth])
+		}
+	}
+
+	if len(diff.Text) != 4 || diff.Text[0].Text != "host: db1" || diff.Text[0].Op != '-' {
+		t.Errorf("unexpected text diff %+v", diff.Text)
+	}
+
+	for _, l := range diff.Text {
+		if strings.Contains(l.Text, "hunter") || strings.Contains(l.Text, "admin") {
+			t.Errorf("text diff leaked plaintext: %q", l.Text)
+		}
+	}
+}
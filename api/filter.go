@@ -0,0 +1,49 @@
+package api
+
+import (
+	"regexp"
+)
+
+// A TagFilter selects tags to decrypt.  Tags it rejects are left encrypted, so that a host can render only the
+// secrets it needs from a shared document.
+type TagFilter func(tag Tag) bool
+
+// KeyNameFilter accepts tags whose key name matches any of patterns, as path.Match patterns.
+func KeyNameFilter(patterns ...string) TagFilter {
+	return func(tag Tag) bool {
+		return matchesAny(tag.KeyName, patterns)
+	}
+}
+
+// AuthDataFilter accepts tags whose auth data matches any of patterns, as path.Match patterns.
+func AuthDataFilter(patterns ...string) TagFilter {
+	return func(tag Tag) bool {
+		return matchesAny(tag.AuthData, patterns)
+	}
+}
+
+// AuthDataRegexpFilter accepts tags whose auth data matches re.
+func AuthDataRegexpFilter(re *regexp.Regexp) TagFilter {
+	return func(tag Tag) bool {
+		return re.MatchString(tag.AuthData)
+	}
+}
+
+// AllFilters accepts tags that every one of filters accepts.
+func AllFilters(filters ...TagFilter) TagFilter {
+	return func(tag Tag) bool {
+		for _, filter := range filters {
+			if !filter(tag) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DecryptTagsFiltered behaves like DecryptTags, or DecryptTagsBound if binding is not nil, but decrypts only
+// the tags filter accepts, leaving the rest encrypted.  Tags left encrypted still count towards the positions
+// of the tags after them.
+func DecryptTagsFiltered(content []byte, keyroot string, binding Binding, filter TagFilter) ([]byte, error) {
+	return decryptTags(content, keyroot, binding, filter)
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDecryptTagsFiltered(t *testing.T) {
+	content := []byte("[gosecret|db password|one] [gosecret|api token|two] [gosecret|db user|three]")
+	encrypted, err := EncryptTagsBound(content, "myteamkey-2014-09-19", "../test_keys", false, DocumentBinding("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := AllFilters(KeyNameFilter("myteamkey-*"), AuthDataFilter("db *"), AuthDataRegexpFilter(regexp.MustCompile("user$")))
+	decrypted, err := DecryptTagsFiltered(encrypted, "../test_keys", DocumentBinding("app"), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := FindTags(decrypted)
+	if len(tags) != 2 || tags[0].AuthData != "db password" || tags[1].AuthData != "api token" ||
+		!strings.HasSuffix(string(decrypted), "] three") {
+		t.Errorf("expected only the db user tag to be decrypted, got %q", decrypted)
+	}
+
+	if decrypted, err := DecryptTagsFiltered(encrypted, "../test_keys", DocumentBinding("app"), KeyNameFilter("otherkey")); err != nil || string(decrypted) != string(encrypted) {
+		t.Errorf("expected no tags to be decrypted, got %q: %v", decrypted, err)
+	}
+}
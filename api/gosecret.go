@@ -56,6 +56,7 @@
 package api
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -63,9 +64,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"path/filepath"
 	"regexp"
-	"strings"
 	"unicode/utf8"
 )
 
@@ -84,10 +83,27 @@ type DecryptionTag struct {
 
 //Encrypt the tag, returns the cypher text
 func (et *EncryptionTag) EncryptTag(keystore string, iv []byte) ([]byte, error) {
-	keypath := filepath.Join(keystore, et.KeyName)
-	key, err := getBytesFromBase64File(keypath)
+	return et.encryptTagFrom(keystore, iv, nil)
+}
 
-	aes, err := aes.NewCipher(key)
+// Encrypt the tag as EncryptTag does, recording origin in the audit log.
+func (et *EncryptionTag) encryptTagFrom(keystore string, iv []byte, origin *AuditOrigin) ([]byte, error) {
+	cipherText, err := et.sealTag(keystore, iv)
+	authData, context := splitBoundAuthData(et.AuthData)
+	if err = recordTag(origin, AuditEncrypt, et.KeyName, authData, context, err); err != nil {
+		return nil, err
+	}
+	return cipherText, nil
+}
+
+func (et *EncryptionTag) sealTag(keystore string, iv []byte) ([]byte, error) {
+	key, err := readKey(keystore, et.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	aes, err := aes.NewCipher(key.Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -105,11 +121,16 @@ func ParseEncrytionTag(keystore string, s ...string) (DecryptionTag, error) {
 		return DecryptionTag{}, fmt.Errorf("expected 3 arguments, got %d", len(s))
 	}
 
+	keyname, err := DataKeyName(s[2])
+	if err != nil {
+		return DecryptionTag{}, err
+	}
+
 	//Create EncryptionTag object
 	et := EncryptionTag{
 		[]byte(s[0]),
 		[]byte(s[1]),
-		s[2],
+		keyname,
 	}
 
 	iv := createIV()
@@ -122,44 +143,100 @@ func ParseEncrytionTag(keystore string, s ...string) (DecryptionTag, error) {
 		[]byte(s[0]),
 		cipherText,
 		iv,
-		s[2],
+		keyname,
 	}
 
 	return dt, nil
 }
 
+// DecryptTag decrypts the tag with a key from keystore.  The plaintext is returned in ordinary memory; callers
+// that can hold it in a SecureBuffer should use DecryptTagSecure.
 func (dt *DecryptionTag) DecryptTag(keystore string) ([]byte, error) {
+	plaintext, err := dt.DecryptTagSecure(keystore)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Destroy()
+
+	return append([]byte{}, plaintext.Bytes()...), nil
+}
+
+// DecryptTagSecure behaves like DecryptTag, but decrypts directly into a SecureBuffer, which the caller must
+// Destroy.
+func (dt *DecryptionTag) DecryptTagSecure(keystore string) (*SecureBuffer, error) {
+	return dt.decryptTagFrom(keystore, nil)
+}
+
+// Decrypt the tag as DecryptTagSecure does, recording origin in the audit log.
+func (dt *DecryptionTag) decryptTagFrom(keystore string, origin *AuditOrigin) (*SecureBuffer, error) {
+	plaintext, err := dt.openTag(keystore)
+	authData, context := splitBoundAuthData(dt.AuthData)
+	if err = recordTag(origin, AuditDecrypt, dt.KeyName, authData, context, err); err != nil {
+		plaintext.Destroy()
+		return nil, err
+	}
+	return plaintext, nil
+}
 
-	keypath, err := getBytesFromBase64File(filepath.Join(keystore, dt.KeyName))
+func (dt *DecryptionTag) openTag(keystore string) (*SecureBuffer, error) {
+	key, err := readKey(keystore, dt.KeyName)
 	if err != nil {
 		fmt.Println("Unable to read file for decryption", err)
 		return nil, err
 	}
+	defer key.Destroy()
 
-
-	aesgcm, err := createCipher(keypath)
+	aesgcm, err := createCipher(key.Bytes())
 	if err != nil {
 		return nil, err
 	}
 
-	return aesgcm.Open(nil, dt.InitVector, dt.CipherText, dt.AuthData)
+	size := len(dt.CipherText) - aesgcm.Overhead()
+	if size < 0 {
+		size = 0
+	}
+	plaintext := NewSecureBuffer(size)
+	if _, err := aesgcm.Open(plaintext.Bytes()[:0], dt.InitVector, dt.CipherText, dt.AuthData); err != nil {
+		plaintext.Destroy()
+		return nil, err
+	}
+	return plaintext, nil
 }
 
+// ParseDecryptionTag decrypts the tag whose auth data, Base64 encoded ciphertext and initialization vector, and
+// key name are given in s, returning the plaintext as a string for use by templates.  Other callers should use
+// ParseDecryptionTagSecure.
 func ParseDecryptionTag(keystore string, s ...string) (string, error) {
+	plaintext, err := ParseDecryptionTagSecure(keystore, s...)
+	if err != nil {
+		return "", err
+	}
+	defer plaintext.Destroy()
+
+	return string(plaintext.Bytes()), nil
+}
+
+// ParseDecryptionTagSecure behaves like ParseDecryptionTag, but returns the plaintext in a SecureBuffer, which
+// the caller must Destroy, instead of a string.
+func ParseDecryptionTagSecure(keystore string, s ...string) (*SecureBuffer, error) {
+	if len(s) == 5 {
+		// The tag is bound to a context, which ParseBoundDecryptionTagSecure will refuse without an expected context.
+		return ParseBoundDecryptionTagSecure(keystore, "", s...)
+	}
 	if len(s) != 4 {
-		return "", fmt.Errorf("expected 4 arguments, go %d", len(s))
+		return nil, fmt.Errorf("expected 4 arguments, go %d", len(s))
 	}
 
 	ct, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
 		fmt.Println("Unable to decode ciphertext", err)
-		return "", err
+		return nil, err
 	}
 
 	iv, err := base64.StdEncoding.DecodeString(s[2])
 	if err != nil {
 		fmt.Println("Unable to decode IV", err)
-		return "", err
+		return nil, err
 	}
 
 	dt := DecryptionTag{
@@ -169,12 +246,7 @@ func ParseDecryptionTag(keystore string, s ...string) (string, error) {
 		s[3],
 	}
 
-	plaintext, err := dt.DecryptTag(keystore)
-	if err != nil {
-		return "", err
-	}
-
-	return string(plaintext), nil
+	return dt.DecryptTagSecure(keystore)
 }
 
 //////////////////////////////////////////////
@@ -248,57 +320,126 @@ func decodeBase64(input []byte) ([]byte, error) {
 	return output[:l], nil
 }
 
-// Given a file path known to contain Base64 encoded data, return a slice containing the decoded data.
-func getBytesFromBase64File(filepath string) ([]byte, error) {
+// Given a file path known to contain Base64 encoded data, return a SecureBuffer containing the decoded data.
+// Key files holding a reference to a key kept by a KeyBackend are unwrapped instead.  The file's contents are
+// wiped once decoded.
+func getBytesFromBase64File(filepath string) (*SecureBuffer, error) {
 	file, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		fmt.Println("Unable to read file", err)
 		return nil, err
 	}
+	defer Wipe(file)
 
-	return decodeBase64(file)
+	return keyFromFile(filepath, file)
 }
 
-// Given an array of encrypted tag parts and a directory of keys, convert the encrypted gosecret tag into
-// a plaintext []byte.
-func decryptTag(tagParts []string, keyroot string) ([]byte, error) {
-	ct, err := base64.StdEncoding.DecodeString(tagParts[2])
+// ReadKey returns the raw key stored, Base64 encoded, in the file named keyname in the keystore search path
+// keyroot, as found by FindKey.  If the file holds a reference to a key kept by a KeyBackend, the key is
+// unwrapped by the backend, as is a key name that is itself such a reference.  The returned slice is a copy
+// that the caller may Wipe once done with it.
+func ReadKey(keyroot, keyname string) ([]byte, error) {
+	key, err := readKey(keyroot, keyname)
 	if err != nil {
-		fmt.Println("Unable to decode ciphertext", tagParts[2], err)
 		return nil, err
 	}
+	defer key.Destroy()
 
-	iv, err := base64.StdEncoding.DecodeString(tagParts[3])
+	return append([]byte{}, key.Bytes()...), nil
+}
+
+// Read a key as ReadKey does, into a SecureBuffer that the caller must Destroy.
+func readKey(keyroot, keyname string) (*SecureBuffer, error) {
+	if backend, _, ref, ok := backendFor(keyname); ok {
+		key, err := backend.UnwrapKey(ref)
+		if err != nil {
+			return nil, err
+		}
+		defer Wipe(key)
+		return NewSecureBufferFrom(key), nil
+	}
+
+	keypath, err := FindKey(keyroot, keyname)
 	if err != nil {
-		fmt.Println("Unable to decode IV", err)
 		return nil, err
 	}
+	return getBytesFromBase64File(keypath)
+}
+
+// WriteKey stores key, Base64 encoded, in the file at path.
+func WriteKey(path string, key []byte) error {
+	encodedKey := make([]byte, base64.StdEncoding.EncodedLen(len(key)))
+	base64.StdEncoding.Encode(encodedKey, key)
+	return ioutil.WriteFile(path, encodedKey, 0600)
+}
+
+// Split a legacy tag matched by gosecretRegex into its parts, the first of which is "gosecret".  The parts are
+// slices of match, so that the plaintext of an unencrypted tag is not copied.
+func splitLegacyTag(match []byte) [][]byte {
+	return bytes.Split(match[1:len(match)-1], []byte("|"))
+}
+
+// Given the parts of an encrypted gosecret tag and a directory of keys, decrypt the tag into a SecureBuffer
+// that the caller must Destroy.
+func decryptTag(tagParts [][]byte, keyroot string) (*SecureBuffer, error) {
+	plaintext, err := openLegacyTag(tagParts, keyroot)
+	context := ""
+	if len(tagParts) > 5 {
+		context = string(tagParts[5])
+	}
+	if err = recordTag(nil, AuditDecrypt, string(tagParts[4]), string(tagParts[1]), context, err); err != nil {
+		plaintext.Destroy()
+		return nil, err
+	}
+	return plaintext, nil
+}
 
-	key, err := getBytesFromBase64File(filepath.Join(keyroot, tagParts[4]))
+func openLegacyTag(tagParts [][]byte, keyroot string) (*SecureBuffer, error) {
+	ct, err := decodeBase64(tagParts[2])
 	if err != nil {
-		fmt.Println("Unable to read file for decryption", err)
+		fmt.Println("Unable to decode ciphertext", string(tagParts[2]), err)
 		return nil, err
 	}
 
-	plaintext, err := decrypt(ct, key, iv, []byte(tagParts[1]))
+	iv, err := decodeBase64(tagParts[3])
 	if err != nil {
+		fmt.Println("Unable to decode IV", err)
 		return nil, err
 	}
 
-	return plaintext, nil
+	ad := append([]byte{}, tagParts[1]...)
+	if len(tagParts) > 5 {
+		ad = boundAuthData(ad, string(tagParts[5]))
+	}
+
+	dt := DecryptionTag{ad, ct, iv, string(tagParts[4])}
+	return dt.openTag(keyroot)
 }
 
-// Given an array of unencrypted tag parts, a []byte containing the key, and a name for the key, generate
-// an encrypted gosecret tag.
-func encryptTag(tagParts []string, key []byte, keyname string) ([]byte, error) {
+// Given the auth data and plaintext of a tag, a []byte containing the key, and a name for the key, generate
+// an encrypted gosecret tag.  If context is not empty, the tag is bound to it.
+func encryptTag(authData string, plaintext, key []byte, keyname, context string) ([]byte, error) {
 	iv := createIV()
-	cipherText, err := encrypt([]byte(tagParts[2]), key, iv, []byte(tagParts[1]))
-	if err != nil {
+	ad := []byte(authData)
+	if context != "" {
+		ad = boundAuthData(ad, context)
+	}
+	cipherText, err := encrypt(plaintext, key, iv, ad)
+	if err = recordTag(nil, AuditEncrypt, keyname, authData, context, err); err != nil {
 		return []byte(""), err
 	}
 
+	if context != "" {
+		return []byte(fmt.Sprintf("[gosecret|%s|%s|%s|%s|%s]",
+			authData,
+			base64.StdEncoding.EncodeToString(cipherText),
+			base64.StdEncoding.EncodeToString(iv),
+			keyname,
+			context)), nil
+	}
+
 	return []byte(fmt.Sprintf("[gosecret|%s|%s|%s|%s]",
-		tagParts[1],
+		authData,
 		base64.StdEncoding.EncodeToString(cipherText),
 		base64.StdEncoding.EncodeToString(iv),
 		keyname)), nil
@@ -308,8 +449,15 @@ func encryptTag(tagParts []string, key []byte, keyname string) ([]byte, error) {
 // array and replaces each with an encrypted gosecret tag.  Note that the input content must be valid UTF-8.
 // The second parameter is the name of the keyfile to use for encrypting all tags in the content, and the
 // third parameter is the 256-bit key itself.
-// EncryptTags returns a []byte with all unencrypted [gosecret] blocks replaced by encrypted gosecret tags.
+// EncryptTags returns a []byte with all unencrypted [gosecret] blocks replaced by encrypted gosecret tags, or an
+// error if any tag cannot be encrypted, rotated or recorded in the audit log.
 func EncryptTags(content []byte, keyname, keyroot string, rotate bool) ([]byte, error) {
+	return encryptTags(content, keyname, keyroot, rotate, nil)
+}
+
+// Encrypt legacy tags, binding each to its context if binding is not nil.  Without a binding, tags that
+// are already bound keep their recorded context when rotated.
+func encryptTags(content []byte, keyname, keyroot string, rotate bool, binding Binding) ([]byte, error) {
 
 	if !utf8.Valid(content) {
 		return nil, errors.New("File is not valid UTF-8")
@@ -319,31 +467,55 @@ func EncryptTags(content []byte, keyname, keyroot string, rotate bool) ([]byte,
 
 	if match {
 
-		keypath := filepath.Join(keyroot, keyname)
-		key, err := getBytesFromBase64File(keypath)
+		keyname, err := DataKeyName(keyname)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readKey(keyroot, keyname)
 		if err != nil {
 			fmt.Println("Unable to read encryption key")
 			return nil, err
 		}
+		defer key.Destroy()
 
+		if binding != nil {
+			for i := range gosecretRegex.FindAllIndex(content, -1) {
+				if err := checkContext(binding(i)); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// Every match is numbered, even one that is not a well-formed tag, as TagIndexes numbers them.  The first
+		// tag that cannot be encrypted, or whose encryption cannot be audited, fails the whole document.
+		var tagErr error
+		index := 0
 		content = gosecretRegex.ReplaceAllFunc(content, func(match []byte) []byte {
-			matchString := string(match)
-			matchString = matchString[:len(matchString)-1]
-			parts := strings.Split(string(matchString), "|")
+			if tagErr != nil {
+				return match
+			}
+			parts := splitLegacyTag(match)
+
+			context := ""
+			if binding != nil {
+				context = binding(index)
+			} else if len(parts) > 5 {
+				context = string(parts[5])
+			}
+			index++
 
 			if len(parts) > 3 {
 				if rotate {
 					plaintext, err := decryptTag(parts, keyroot)
 					if err != nil {
-						fmt.Println("Unable to decrypt ciphertext", parts[2], err)
+						tagErr = err
 						return nil
 					}
+					defer plaintext.Destroy()
 
-					parts[2] = string(plaintext)
-
-					replacement, err := encryptTag(parts, key, keyname)
+					replacement, err := encryptTag(string(parts[1]), plaintext.Bytes(), key.Bytes(), keyname, context)
 					if err != nil {
-						fmt.Println("Failed to encrypt tag", err)
+						tagErr = err
 						return nil
 					}
 					return replacement
@@ -351,14 +523,17 @@ func EncryptTags(content []byte, keyname, keyroot string, rotate bool) ([]byte,
 					return match
 				}
 			} else {
-				replacement, err := encryptTag(parts, key, keyname)
+				replacement, err := encryptTag(string(parts[1]), parts[2], key.Bytes(), keyname, context)
 				if err != nil {
-					fmt.Println("Failed to encrypt tag", err)
+					tagErr = err
 					return nil
 				}
 				return replacement
 			}
 		})
+		if tagErr != nil {
+			return nil, tagErr
+		}
 	}
 
 	return content, nil
@@ -369,31 +544,76 @@ func EncryptTags(content []byte, keyname, keyroot string, rotate bool) ([]byte,
 // input content must be valid UTF-8.  The second parameter is the path to the directory in which keyfiles
 // live.  For each |keyname| in a gosecret block, there must be a corresponding file of the same name in the
 // keystore directory.
-// DecryptTags returns a []byte with all [gosecret] blocks replaced by plaintext.
+// DecryptTags returns a []byte with all [gosecret] blocks replaced by plaintext, or an error if any tag cannot
+// be decrypted or recorded in the audit log.  Tags bound to a context cannot be decrypted by DecryptTags; use
+// DecryptTagsBound.
 func DecryptTags(content []byte, keyroot string) ([]byte, error) {
+	return decryptTags(content, keyroot, nil, nil)
+}
+
+// Decrypt legacy tags.  If binding is not nil, every encrypted tag must be bound to the context the binding
+// expects at its position; otherwise, no encrypted tag may be bound.  If filter is not nil, tags it rejects
+// are left encrypted.
+func decryptTags(content []byte, keyroot string, binding Binding, filter TagFilter) ([]byte, error) {
 
 	if !utf8.Valid(content) {
 		return nil, errors.New("File is not valid UTF-8")
 	}
 
+	// ReplaceAllFunc copies each plaintext into its result as soon as it is returned, so the buffers holding
+	// them can be destroyed once it is done.
+	var opened []*SecureBuffer
+	defer func() {
+		for _, plaintext := range opened {
+			plaintext.Destroy()
+		}
+	}()
+
+	// Every match is numbered, even one that is not a well-formed tag, as TagIndexes numbers them.  The first
+	// tag that cannot be decrypted, or whose decryption cannot be audited, fails the whole document.
+	var tagErr error
+	index := 0
 	content = gosecretRegex.ReplaceAllFunc(content, func(match []byte) []byte {
-		matchString := string(match)
-		matchString = matchString[:len(matchString)-1]
-		parts := strings.Split(matchString, "|")
+		if tagErr != nil {
+			return match
+		}
+		parts := splitLegacyTag(match)
+
+		context := ""
+		if binding != nil {
+			context = binding(index)
+		}
+		index++
 
 		if len(parts) < 5 {
 			// Block is not encrypted.  Noop.
 			return match
+		} else if tag, ok := parseLegacyTag(match); filter != nil && (!ok || !filter(tag)) {
+			return match
 		} else {
+			recorded := ""
+			if len(parts) > 5 {
+				recorded = string(parts[5])
+			}
+			if err := checkBinding(string(parts[1]), recorded, context); err != nil {
+				tagErr = err
+				return nil
+			}
+
 			plaintext, err := decryptTag(parts, keyroot)
 			if err != nil {
-				fmt.Println("Unable to decrypt tag", err)
+				tagErr = err
 				return nil
 			}
 
-			return plaintext
+			opened = append(opened, plaintext)
+			return plaintext.Bytes()
 		}
 	})
 
+	if tagErr != nil {
+		return nil, tagErr
+	}
+
 	return content, nil
 }
@@ -64,7 +64,7 @@ func TestParsingTag(t *testing.T) {
 // End of new tests
 ///////////////////
 
-func Testencrypt(t *testing.T) {
+func TestEncrypt(t *testing.T) {
 
 	key := CreateKey()
 	iv := createIV()
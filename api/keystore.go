@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeystoreDirs returns the directories of a keystore search path, in order of precedence.  Wherever this
+// package takes a keyroot, it may be a single directory or several separated by os.PathListSeparator (':' on
+// Unix), and a key is read from the first directory that has a file of its name.
+func KeystoreDirs(keyroot string) []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(keyroot) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// CheckKeyName returns an error unless keyname can name a key file in a keystore directory: a single file name,
+// other than . and .., so that the name cannot refer to a file outside the keystore.
+func CheckKeyName(keyname string) error {
+	if keyname == "" || keyname == "." || keyname == ".." || strings.ContainsAny(keyname, `/\`) ||
+		filepath.Base(keyname) != keyname {
+		return fmt.Errorf("invalid key name %q: a key name must be a single file name", keyname)
+	}
+	return nil
+}
+
+// FindKey returns the path of the file holding the key named keyname in the keystore search path keyroot.
+// If no directory has the key, the error lists every location checked.
+func FindKey(keyroot, keyname string) (string, error) {
+	var checked []string
+	for _, dir := range KeystoreDirs(keyroot) {
+		keypath := filepath.Join(dir, keyname)
+		_, err := os.Stat(keypath)
+		if err == nil {
+			return keypath, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		checked = append(checked, keypath)
+	}
+	return "", fmt.Errorf("key %s not found in keystore; checked %s", keyname, strings.Join(checked, ", "))
+}
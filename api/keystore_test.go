@@ -0,0 +1,49 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeystoreSearchPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	host, platform := filepath.Join(dir, "host"), filepath.Join(dir, "platform")
+	os.Mkdir(host, 0700)
+	os.Mkdir(platform, 0700)
+	hostKey, platformKey := CreateKey(), CreateKey()
+	WriteKey(filepath.Join(host, "shared"), hostKey)
+	WriteKey(filepath.Join(platform, "shared"), platformKey)
+	WriteKey(filepath.Join(platform, "platform-only"), platformKey)
+
+	keyroot := strings.Join([]string{host, "", platform}, string(os.PathListSeparator))
+
+	if key, err := ReadKey(keyroot, "shared"); err != nil || !bytes.Equal(key, hostKey) {
+		t.Errorf("expected the first directory to take precedence, got %v", err)
+	}
+	if keypath, err := FindKey(keyroot, "platform-only"); err != nil || keypath != filepath.Join(platform, "platform-only") {
+		t.Errorf("unexpected location %q: %v", keypath, err)
+	}
+
+	_, err = FindKey(keyroot, "missing")
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(host, "missing")) || !strings.Contains(err.Error(), filepath.Join(platform, "missing")) {
+		t.Errorf("expected the error to list every location checked, got %v", err)
+	}
+
+	content := []byte("[gosecret|auth|text]")
+	encrypted, err := EncryptTags(content, "platform-only", keyroot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := DecryptTags(encrypted, keyroot); err != nil || string(decrypted) != "text" {
+		t.Errorf("unexpected decryption %q: %v", decrypted, err)
+	}
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KMSScheme is the scheme of key names referring to data keys protected by a KMSBackend.
+const KMSScheme = "kms"
+
+// A KMSBackend is a KeyGenerator whose master keys are held by a service with the JSON API of AWS KMS, such as
+// AWS KMS itself or a local KMS emulator.  To encrypt with a KMS key, name it as kms:<key id, ARN or alias>.
+// A data key is then generated under the KMS key, and tags record it, wrapped by KMS, in their key name:
+//
+//	kms:<Base64 wrapped data key>:<KMS key ARN>
+//
+// so that decryption needs only the tag and access to KMS.  Each KMS key generates one data key for the life
+// of the backend, and unwrapped data keys are cached in locked memory until Close, so KMS is called once per key
+// rather than once per tag.
+type KMSBackend struct {
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+
+	lock      sync.Mutex
+	generated map[string]string
+	cache     keyCache
+}
+
+// NewKMSBackend returns a KMSBackend for the KMS service in region, signing requests with the given AWS
+// credentials; sessionToken may be empty.  If endpoint is empty, the AWS KMS endpoint for the region is used.
+func NewKMSBackend(endpoint, region, accessKey, secretKey, sessionToken string) *KMSBackend {
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com/"
+	}
+	return &KMSBackend{
+		endpoint:     endpoint,
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		generated:    make(map[string]string),
+		cache:        make(keyCache),
+	}
+}
+
+// DataKey returns the reference of a data key generated under the KMS key named by ref, or ref itself if it
+// already refers to a data key.
+func (k *KMSBackend) DataKey(ref string) (string, error) {
+	if _, _, ok := splitKMSRef(ref); ok {
+		return ref, nil
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if dataKey, ok := k.generated[ref]; ok {
+		return dataKey, nil
+	}
+
+	var response struct {
+		CiphertextBlob string
+		Plaintext      string
+		KeyId          string
+	}
+	if err := k.call("GenerateDataKey", map[string]string{"KeyId": ref, "KeySpec": "AES_256"}, &response); err != nil {
+		return "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("KMS GenerateDataKey with key %s returned a malformed data key", ref)
+	}
+
+	defer Wipe(key)
+
+	dataKey := response.CiphertextBlob + ":" + response.KeyId
+	k.generated[ref] = dataKey
+	k.cache.put(dataKey, key)
+	return dataKey, nil
+}
+
+// UnwrapKey returns the data key ref refers to, asking KMS to decrypt it unless it is cached.
+func (k *KMSBackend) UnwrapKey(ref string) ([]byte, error) {
+	blob, keyID, ok := splitKMSRef(ref)
+	if !ok {
+		return nil, fmt.Errorf("kms:%s names a KMS key, not a data key; it can only be used to encrypt", ref)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if key, ok := k.cache.get(ref); ok {
+		return key, nil
+	}
+
+	var response struct {
+		Plaintext string
+	}
+	if err := k.call("Decrypt", map[string]string{"CiphertextBlob": blob, "KeyId": keyID}, &response); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt with key %s returned a malformed data key: %v", keyID, err)
+	}
+
+	k.cache.put(ref, key)
+	return key, nil
+}
+
+// Close wipes the cached data keys.  The backend remains usable, but asks KMS to unwrap keys again.
+func (k *KMSBackend) Close() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.cache.clear()
+}
+
+// Split a data key reference into the Base64 wrapped data key and the KMS key ID.  KMS key IDs, ARNs and
+// aliases are never valid Base64 followed by ':', so they are not mistaken for data key references.
+func splitKMSRef(ref string) (string, string, bool) {
+	i := strings.IndexByte(ref, ':')
+	if i <= 0 {
+		return "", "", false
+	}
+	if _, err := base64.StdEncoding.DecodeString(ref[:i]); err != nil {
+		return "", "", false
+	}
+	return ref[:i], ref[i+1:], true
+}
+
+// Call a KMS operation, such as Decrypt, with the JSON protocol.
+func (k *KMSBackend) call(operation string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+operation)
+	k.sign(req, body, time.Now().UTC())
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("KMS %s failed: %v", operation, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(message, &failure) == nil && failure.Type != "" {
+			message = []byte(failure.Type + ": " + failure.Message)
+		}
+		return fmt.Errorf("KMS %s failed: %s: %s", operation, resp.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Sign a request with AWS Signature Version 4.
+func (k *KMSBackend) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if k.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", k.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, canonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + k.region + "/kms/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + k.secretKey)
+	for _, part := range []string{date, k.region, "kms", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+k.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
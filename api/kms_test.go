@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A stub of the KMS GenerateDataKey and Decrypt operations, which "wraps" data keys by remembering them.
+func newKMSStub(t *testing.T) (*httptest.Server, map[string]int) {
+	var wrapped [][]byte
+	calls := make(map[string]int)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			r.Header.Get("X-Amz-Date") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"MissingAuthenticationTokenException","message":"unsigned"}`))
+			return
+		}
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+		calls[operation]++
+
+		switch operation {
+		case "GenerateDataKey":
+			if request["KeyId"] != "alias/gosecret" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"NotFoundException","message":"no such key"}`))
+				return
+			}
+			key := CreateKey()
+			wrapped = append(wrapped, key)
+			json.NewEncoder(w).Encode(map[string]string{
+				"CiphertextBlob": base64.StdEncoding.EncodeToString([]byte{byte(len(wrapped) - 1), 0, 0}),
+				"Plaintext":      base64.StdEncoding.EncodeToString(key),
+				"KeyId":          "arn:aws:kms:us-east-1:111122223333:key/1234abcd",
+			})
+		case "Decrypt":
+			blob, _ := base64.StdEncoding.DecodeString(request["CiphertextBlob"])
+			json.NewEncoder(w).Encode(map[string]string{
+				"Plaintext": base64.StdEncoding.EncodeToString(wrapped[blob[0]]),
+			})
+		}
+	})), calls
+}
+
+func TestKMSBackend(t *testing.T) {
+	stub, calls := newKMSStub(t)
+	defer stub.Close()
+
+	RegisterKeyBackend(KMSScheme, NewKMSBackend(stub.URL, "us-east-1", "AKID", "secret", ""))
+	encrypted, err := EncryptTags([]byte("[gosecret|a|one] {{goEncrypt \"b\" \"two\" \"kms:alias/gosecret\"}}"), "kms:alias/gosecret", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := FindTags(encrypted)
+	if len(tags) != 2 || tags[0].KeyName != "kms:AAAA:arn:aws:kms:us-east-1:111122223333:key/1234abcd" {
+		t.Fatalf("expected the wrapped data key to be recorded in the tag, got %+v", tags)
+	}
+	template, err := tags[1].Encrypt("kms:alias/gosecret", "", "")
+	if err != nil || template.KeyName != tags[0].KeyName {
+		t.Fatalf("expected the data key to be reused, got %+v: %v", template, err)
+	}
+
+	// A new backend, as in another process, has to unwrap the data key.
+	RegisterKeyBackend(KMSScheme, NewKMSBackend(stub.URL, "us-east-1", "AKID", "secret", ""))
+	defer RegisterKeyBackend(KMSScheme, nil)
+	decrypted, err := DecryptTags(encrypted, "")
+	if err != nil || !strings.HasPrefix(string(decrypted), "one ") {
+		t.Errorf("unexpected decryption %q: %v", decrypted, err)
+	}
+	if plaintext, err := template.Decrypt(""); err != nil || string(plaintext) != "two" {
+		t.Errorf("unexpected decryption %q: %v", plaintext, err)
+	}
+	if calls["GenerateDataKey"] != 1 || calls["Decrypt"] != 1 {
+		t.Errorf("expected one call of each operation, got %v", calls)
+	}
+
+	if _, err := DataKeyName("kms:alias/missing"); err == nil || !strings.Contains(err.Error(), "NotFoundException") {
+		t.Errorf("expected the service's error, got %v", err)
+	}
+}
+
+func TestKMSBackendClose(t *testing.T) {
+	stub, calls := newKMSStub(t)
+	defer stub.Close()
+
+	backend := NewKMSBackend(stub.URL, "us-east-1", "AKID", "secret", "")
+	ref, err := backend.DataKey("alias/gosecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := backend.UnwrapKey(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{}, key...)
+
+	// Wiping the returned key must not wipe the cached one.
+	Wipe(key)
+	if key, err := backend.UnwrapKey(ref); err != nil || !bytes.Equal(key, expected) || calls["Decrypt"] != 0 {
+		t.Errorf("expected the cached key to be unchanged, got %v after %v: %v", key, calls, err)
+	}
+
+	// Replacing a registered backend closes it, destroying the cached keys.
+	RegisterKeyBackend(KMSScheme, backend)
+	RegisterKeyBackend(KMSScheme, nil)
+	if len(backend.cache) != 0 {
+		t.Errorf("expected closing the backend to empty its cache, got %d keys", len(backend.cache))
+	}
+	if key, err := backend.UnwrapKey(ref); err != nil || !bytes.Equal(key, expected) || calls["Decrypt"] != 1 {
+		t.Errorf("expected a closed backend to unwrap the key again, got %v after %v: %v", key, calls, err)
+	}
+}
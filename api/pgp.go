@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// PGPScheme is the scheme of key names referring to data keys encrypted to OpenPGP keys.
+const PGPScheme = "pgp"
+
+// A PGPBackend is a KeyGenerator that protects data keys by encrypting them to OpenPGP public keys, for teams
+// that distribute keys with PGP.  To encrypt with it, name the recipients as pgp:<recipient>[,<recipient>...],
+// where each recipient is a key ID or fingerprint in hex, or an email address, found in the public keyring.  A
+// data key is then generated and tags record it, as an OpenPGP message, in their key name:
+//
+//	pgp:<Base64 OpenPGP message>
+//
+// Decryption needs the secret key of one of the recipients in the secret keyring.
+type PGPBackend struct {
+	public     openpgp.EntityList
+	secret     openpgp.EntityList
+	passphrase []byte
+
+	lock      sync.Mutex
+	generated map[string]string
+	cache     keyCache
+}
+
+// NewPGPBackend returns a PGPBackend that encrypts data keys to keys in the public keyring and decrypts them
+// with keys in the secret keyring, which are decrypted with passphrase if they are protected by one.  Either
+// keyring may be empty if the backend is only used to encrypt or to decrypt.
+func NewPGPBackend(public, secret openpgp.EntityList, passphrase []byte) *PGPBackend {
+	return &PGPBackend{
+		public:     public,
+		secret:     secret,
+		passphrase: passphrase,
+		generated:  make(map[string]string),
+		cache:      make(keyCache),
+	}
+}
+
+// ReadKeyring reads an OpenPGP keyring, either ASCII armored or binary.
+func ReadKeyring(r io.Reader) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		return openpgp.ReadKeyRing(block.Body)
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// Report whether ref is a data key reference rather than a list of recipients.  OpenPGP packets always have
+// the high bit of their first byte set, and a data key message is far longer than any key ID or fingerprint.
+func isPGPMessage(ref string) bool {
+	message, err := base64.StdEncoding.DecodeString(ref)
+	return err == nil && len(message) >= 64 && message[0]&0x80 != 0
+}
+
+// DataKey returns the reference of a data key encrypted to the comma separated recipients in ref, or ref
+// itself if it already refers to a data key.
+func (p *PGPBackend) DataKey(ref string) (string, error) {
+	if isPGPMessage(ref) {
+		return ref, nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if dataKey, ok := p.generated[ref]; ok {
+		return dataKey, nil
+	}
+
+	var recipients openpgp.EntityList
+	for _, s := range strings.Split(ref, ",") {
+		entity, err := p.findRecipient(strings.TrimSpace(s))
+		if err != nil {
+			return "", err
+		}
+		recipients = append(recipients, entity)
+	}
+
+	key := CreateKey()
+	defer Wipe(key)
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, recipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(key); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	dataKey := base64.StdEncoding.EncodeToString(buf.Bytes())
+	p.generated[ref] = dataKey
+	p.cache.put(dataKey, key)
+	return dataKey, nil
+}
+
+// Find the key in the public keyring a recipient names.
+func (p *PGPBackend) findRecipient(recipient string) (*openpgp.Entity, error) {
+	entity, err := FindPGPKey(p.public, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("OpenPGP recipient %s not found in the public keyring", recipient)
+	}
+	return entity, nil
+}
+
+// FindPGPKey returns the key in keyring that name identifies, by key ID or fingerprint in hex, optionally
+// prefixed with 0x, or by the email address of one of its identities.
+func FindPGPKey(keyring openpgp.EntityList, name string) (*openpgp.Entity, error) {
+	id := strings.ToUpper(strings.TrimPrefix(strings.ToLower(name), "0x"))
+	for _, entity := range keyring {
+		fingerprint := strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]))
+		if id == fingerprint || id == entity.PrimaryKey.KeyIdString() || id == entity.PrimaryKey.KeyIdShortString() {
+			return entity, nil
+		}
+		for _, identity := range entity.Identities {
+			if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, name) {
+				return entity, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no OpenPGP key %s in the keyring", name)
+}
+
+// UnwrapKey returns the data key ref refers to, decrypting it with the secret keyring unless it is cached.
+func (p *PGPBackend) UnwrapKey(ref string) ([]byte, error) {
+	if !isPGPMessage(ref) {
+		return nil, fmt.Errorf("pgp:%s names OpenPGP recipients, not a data key; it can only be used to encrypt", ref)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key, ok := p.cache.get(ref); ok {
+		return key, nil
+	}
+
+	message, _ := base64.StdEncoding.DecodeString(ref)
+	prompted := false
+	details, err := openpgp.ReadMessage(bytes.NewReader(message), p.secret, func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted || len(p.passphrase) == 0 || symmetric {
+			return nil, fmt.Errorf("no passphrase for the OpenPGP secret key")
+		}
+		prompted = true
+		for _, k := range keys {
+			if k.PrivateKey != nil && k.PrivateKey.Encrypted {
+				if err := k.PrivateKey.Decrypt(p.passphrase); err != nil {
+					return nil, fmt.Errorf("incorrect passphrase for OpenPGP secret key %s", k.PrivateKey.KeyIdString())
+				}
+			}
+		}
+		return nil, nil
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt OpenPGP data key: %v", err)
+	}
+	key, err := ioutil.ReadAll(details.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cache.put(ref, key)
+	return key, nil
+}
+
+// Close wipes the cached data keys.  The backend remains usable, but decrypts data keys again.
+func (p *PGPBackend) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.cache.clear()
+}
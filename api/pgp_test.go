@@ -0,0 +1,87 @@
+package api
+
+import (
+	"bytes"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"strings"
+	"testing"
+)
+
+func TestPGPBackend(t *testing.T) {
+	var entities openpgp.EntityList
+	for _, name := range []string{"alice", "bob", "eve"} {
+		entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, entity)
+	}
+	alice, bob, eve := entities[0], entities[1], entities[2]
+
+	// Round trip the public keyring, as the command line reads it from a file.
+	var buf bytes.Buffer
+	for _, entity := range entities {
+		if err := entity.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	public, err := ReadKeyring(&buf)
+	if err != nil || len(public) != 3 {
+		t.Fatalf("unable to read the public keyring: %v", err)
+	}
+
+	RegisterKeyBackend(PGPScheme, NewPGPBackend(public, nil, nil))
+	defer RegisterKeyBackend(PGPScheme, nil)
+	keyname := "pgp:alice@example.com,0x" + bob.PrimaryKey.KeyIdString()
+	encrypted, err := EncryptTags([]byte("[gosecret|db|hunter2]"), keyname, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := FindTags(encrypted)
+	if len(tags) != 1 || !strings.HasPrefix(tags[0].KeyName, "pgp:") || isPGPMessage(keyname[4:]) {
+		t.Fatalf("expected the tag to record an OpenPGP encrypted data key, got %q", encrypted)
+	}
+
+	for _, entity := range []*openpgp.Entity{alice, bob} {
+		RegisterKeyBackend(PGPScheme, NewPGPBackend(nil, openpgp.EntityList{entity}, nil))
+		if decrypted, err := DecryptTags(encrypted, ""); err != nil || string(decrypted) != "hunter2" {
+			t.Errorf("unexpected decryption %q: %v", decrypted, err)
+		}
+	}
+
+	RegisterKeyBackend(PGPScheme, NewPGPBackend(nil, openpgp.EntityList{eve}, nil))
+	if _, err := tags[0].Decrypt(""); err == nil {
+		t.Error("expected decryption without a recipient's secret key to fail")
+	}
+
+	RegisterKeyBackend(PGPScheme, NewPGPBackend(public, nil, nil))
+	if _, err := EncryptTags([]byte("[gosecret|db|hunter2]"), "pgp:mallory@example.com", "", false); err == nil {
+		t.Error("expected encryption to an unknown recipient to fail")
+	}
+}
+
+func TestPGPPassphrase(t *testing.T) {
+	entity, err := openpgp.NewEntity("alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterKeyBackend(PGPScheme, NewPGPBackend(openpgp.EntityList{entity}, nil, nil))
+	defer RegisterKeyBackend(PGPScheme, nil)
+	encrypted, err := EncryptTags([]byte("[gosecret|db|hunter2]"), "pgp:alice@example.com", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.EncryptPrivateKeys([]byte("correct horse"), nil); err != nil {
+		t.Fatal(err)
+	}
+	tag := FindTags(encrypted)[0]
+
+	RegisterKeyBackend(PGPScheme, NewPGPBackend(nil, openpgp.EntityList{entity}, []byte("battery staple")))
+	if _, err := tag.Decrypt(""); err == nil || !strings.Contains(err.Error(), "incorrect passphrase") {
+		t.Errorf("expected decryption with the wrong passphrase to fail, got %v", err)
+	}
+	RegisterKeyBackend(PGPScheme, NewPGPBackend(nil, openpgp.EntityList{entity}, []byte("correct horse")))
+	if decrypted, err := tag.Decrypt(""); err != nil || string(decrypted) != "hunter2" {
+		t.Errorf("unexpected decryption %q: %v", decrypted, err)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// RedactTags returns a copy of content, safe to display or log, in which every tag, legacy or template
+// (written with the given delimiters, or {{ }} if they are empty) and encrypted or not, is replaced by a
+// placeholder naming its auth data:
+//
+//	<secret: my mongo db password>
+//
+// If keyroot is not empty, every encrypted tag is first decrypted, so that RedactTags fails if any secret
+// cannot be, and the placeholder also shows the length of the secret in characters and, if showLast is
+// positive, up to its last showLast characters.  No more than a quarter of any secret is shown:
+//
+//	<secret: my mongo db password (13 characters, ending "klz")>
+func RedactTags(content []byte, keyroot, left, right string, showLast int) ([]byte, error) {
+	if !utf8.Valid(content) {
+		return nil, errors.New("File is not valid UTF-8")
+	}
+
+	content, _ = RemoveSeal(content)
+	return ReplaceTags(content, FindTagsDelims(content, left, right), func(tag Tag) ([]byte, error) {
+		if keyroot == "" {
+			return []byte(placeholder(tag)), nil
+		}
+
+		plaintext, err := tag.DecryptSecure(keyroot)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt tag %q at line %d: %v", tag.AuthData, tag.Line, err)
+		}
+		defer plaintext.Destroy()
+		secret := bytes.Runes(plaintext.Bytes())
+
+		shown := showLast
+		if shown > len(secret)/4 {
+			shown = len(secret) / 4
+		}
+		description := fmt.Sprintf("%d characters", len(secret))
+		if shown > 0 {
+			description += fmt.Sprintf(", ending %q", string(secret[len(secret)-shown:]))
+		}
+		for i := range secret {
+			secret[i] = 0
+		}
+		return []byte("<secret: " + tag.AuthData + " (" + description + ")>"), nil
+	})
+}
+
+// Return the placeholder that stands for a tag in redacted text.
+func placeholder(tag Tag) string {
+	return "<secret: " + tag.AuthData + ">"
+}
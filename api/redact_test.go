@@ -0,0 +1,37 @@
+package api
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestRedactTags(t *testing.T) {
+	file, err := ioutil.ReadFile(path.Join("../test_data/template", "encrypted_hybrid.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redacted, err := RedactTags(file, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n  \"dbpassword\" : \"<secret: MySql Password>\",\n  \"dbpassword2\": \"<secret: MySql Password 2>\"\n}\n"
+	if string(redacted) != expected {
+		t.Errorf("unexpected redaction %q", redacted)
+	}
+
+	redacted, err = RedactTags(file, "../test_keys", "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "{\n  \"dbpassword\" : \"<secret: MySql Password (13 characters, ending \"klz\")>\",\n" +
+		"  \"dbpassword2\": \"<secret: MySql Password 2 (13 characters, ending \"klz\")>\"\n}\n"
+	if string(redacted) != expected {
+		t.Errorf("unexpected redaction %q", redacted)
+	}
+
+	if _, err := RedactTags(file, "../test_data", "", "", 0); err == nil {
+		t.Error("expected verification to fail without the key")
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"errors"
+	"path"
+	"unicode/utf8"
+)
+
+// RotateTags re-encrypts encrypted tags in both the legacy and template formats with the key named keyname,
+// leaving the rest of content, including unencrypted tags, unchanged.  Each tag is decrypted with the key it
+// names.  Template tags are those written with the given delimiters, or {{ }} if they are empty.
+//
+// If oldKeys is not empty, only tags whose key name matches one of its path.Match patterns are rotated.  If
+// binding is not nil, rotated tags are bound to the context it returns for their position, as numbered by
+// TagIndexes; otherwise they keep the context they were bound to, if any.
+func RotateTags(content []byte, keyname, keyroot, left, right string, binding Binding, oldKeys []string) ([]byte, error) {
+	if !utf8.Valid(content) {
+		return nil, errors.New("File is not valid UTF-8")
+	}
+
+	tags := FindTagsDelims(content, left, right)
+	indexes := TagIndexes(content, tags)
+
+	return ReplaceTags(content, tags, func(tag Tag) ([]byte, error) {
+		original := content[tag.Offset : tag.Offset+tag.Length]
+		if !tag.Encrypted || !matchesAny(tag.KeyName, oldKeys) {
+			return original, nil
+		}
+
+		plaintext, err := tag.DecryptSecure(keyroot)
+		if err != nil {
+			return nil, err
+		}
+		defer plaintext.Destroy()
+
+		context := tag.Context
+		if binding != nil {
+			context = binding(indexes[tag.Offset])
+		}
+
+		unencrypted := tag
+		unencrypted.Encrypted = false
+		unencrypted.Plaintext = plaintext.Bytes()
+		rotated, err := unencrypted.Encrypt(keyname, keyroot, context)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(rotated.String()), nil
+	})
+}
+
+// Report whether name matches any of patterns, or whether there are no patterns.
+func matchesAny(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateTags(t *testing.T) {
+	keyroot, err := ioutil.TempDir("", "gosecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyroot)
+
+	old, err := ReadKey("../test_keys", "myteamkey-2014-09-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string][]byte{"old-a": old, "old-b": old, "new": CreateKey()} {
+		if err := WriteKey(filepath.Join(keyroot, name), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var content []byte
+	for i, keyname := range []string{"old-a", "old-b"} {
+		for _, format := range []TagFormat{LegacyFormat, TemplateFormat} {
+			tag, err := Tag{Format: format, AuthData: keyname, Plaintext: []byte{'0' + byte(i)}}.Encrypt(keyname, keyroot, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = append(content, tag.String()+"\n"...)
+		}
+	}
+	content = append(content, "{{ .Other }} [gosecret|plain|text]\n"...)
+
+	rotated, err := RotateTags(content, "new", keyroot, "", "", nil, []string{"*-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := FindTags(rotated)
+	if len(tags) != 5 {
+		t.Fatalf("expected 5 tags, got %d in %q", len(tags), rotated)
+	}
+	for i, expected := range []string{"new", "new", "old-b", "old-b", ""} {
+		if tags[i].KeyName != expected {
+			t.Errorf("expected tag %d to use key %q, got %q", i, expected, tags[i].KeyName)
+		}
+	}
+	if string(rotated[tags[4].Offset-13:]) != "{{ .Other }} [gosecret|plain|text]\n" {
+		t.Errorf("expected other text to be unchanged in %q", rotated)
+	}
+
+	decrypted, err := DecryptTemplateTags(rotated, keyroot, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err = DecryptTags(decrypted, keyroot); err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "0\n0\n1\n1\n{{ .Other }} [gosecret|plain|text]\n" {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+}
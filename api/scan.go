@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// The white space text/template's trim markers remove.
+const trimSpace = " \t\r\n"
+
+// EncryptTemplateTags encrypts every goEncrypt tag in content, written with the given delimiters (empty for the
+// default {{ }}), using the key each tag names.  Unlike rendering content as a template, only goEncrypt tags
+// are touched: other template actions, goDecrypt tags, legacy tags and all other text are copied byte-for-byte.
+// Trim markers are kept on the encrypted tags.  If binding is not nil, each tag is bound to the context it
+// returns for the tag's position among the template tags.
+func EncryptTemplateTags(content []byte, keyroot, left, right string, binding Binding) ([]byte, error) {
+	if !utf8.Valid(content) {
+		return nil, errors.New("File is not valid UTF-8")
+	}
+
+	tags := templateTags(FindTagsDelims(content, left, right))
+	index := 0
+	return ReplaceTags(content, tags, func(tag Tag) ([]byte, error) {
+		context := ""
+		if binding != nil {
+			context = binding(index)
+		}
+		index++
+
+		if tag.Encrypted {
+			return content[tag.Offset : tag.Offset+tag.Length], nil
+		}
+		encrypted, err := tag.Encrypt(tag.KeyName, keyroot, context)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(encrypted.String()), nil
+	})
+}
+
+// DecryptTemplateTags replaces every goDecrypt and goEncrypt tag in content, written with the given delimiters
+// (empty for the default {{ }}), with its plaintext, applying the tag's trim markers as text/template would.
+// All other text, including other template actions, is copied byte-for-byte.  If binding is not nil, every
+// encrypted tag must be bound to the context it returns for the tag's position; otherwise, no tag may be bound.
+func DecryptTemplateTags(content []byte, keyroot, left, right string, binding Binding) ([]byte, error) {
+	return decryptTemplateTags(content, keyroot, left, right, binding, nil)
+}
+
+// DecryptTemplateTagsFiltered behaves like DecryptTemplateTags, but decrypts only the encrypted tags filter
+// accepts, leaving the rest, including their trim markers, as they are.
+func DecryptTemplateTagsFiltered(content []byte, keyroot, left, right string, binding Binding, filter TagFilter) ([]byte, error) {
+	return decryptTemplateTags(content, keyroot, left, right, binding, filter)
+}
+
+func decryptTemplateTags(content []byte, keyroot, left, right string, binding Binding, filter TagFilter) ([]byte, error) {
+	if !utf8.Valid(content) {
+		return nil, errors.New("File is not valid UTF-8")
+	}
+
+	var opened []*SecureBuffer
+	defer func() { destroyAll(opened) }()
+	index := -1
+	return ReplaceTagsTrimmed(content, templateTags(FindTagsDelims(content, left, right)), func(tag Tag) ([]byte, bool, error) {
+		index++
+		if tag.Encrypted && filter != nil && !filter(tag) {
+			return nil, false, nil
+		}
+		if tag.Encrypted {
+			expected := ""
+			if binding != nil {
+				expected = binding(index)
+			}
+			if err := checkBinding(tag.AuthData, tag.Context, expected); err != nil {
+				return nil, false, err
+			}
+		}
+		plaintext, err := tag.DecryptSecure(keyroot)
+		if err != nil {
+			return nil, false, err
+		}
+		opened = append(opened, plaintext)
+		return plaintext.Bytes(), true, nil
+	})
+}
+
+// ReplaceTagsTrimmed behaves like ReplaceTags, but applies the trim markers of every tag that replace replaces as
+// text/template would, removing the white space before and after the tag.  Tags that replace reports it did not
+// replace are copied as they are, trim markers and any legacy tags in their arguments included.
+func ReplaceTagsTrimmed(content []byte, tags []Tag, replace func(Tag) ([]byte, bool, error)) ([]byte, error) {
+	var buf bytes.Buffer
+	last := 0
+	for _, tag := range tags {
+		if tag.Offset < last {
+			// A legacy tag inside the arguments of a template tag is replaced along with the template tag.
+			continue
+		}
+		replacement, replaced, err := replace(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !replaced {
+			buf.Write(content[last : tag.Offset+tag.Length])
+			last = tag.Offset + tag.Length
+			continue
+		}
+
+		text := content[last:tag.Offset]
+		if tag.TrimLeft {
+			text = bytes.TrimRight(text, trimSpace)
+		}
+		buf.Write(text)
+		buf.Write(replacement)
+
+		last = tag.Offset + tag.Length
+		if tag.TrimRight {
+			for last < len(content) && bytes.IndexByte([]byte(trimSpace), content[last]) >= 0 {
+				last++
+			}
+		}
+	}
+	buf.Write(content[last:])
+	return buf.Bytes(), nil
+}
+
+// Select the template tags from tags, leaving out legacy tags.
+func templateTags(tags []Tag) []Tag {
+	var selected []Tag
+	for _, tag := range tags {
+		if tag.Format == TemplateFormat {
+			selected = append(selected, tag)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplateTagsOnly(t *testing.T) {
+	content := []byte("host: {{ .Values.host }} {{ if }\n" +
+		"password: {{- goEncrypt \"db\" \"hunter2\" \"myteamkey-2014-09-19\" -}}\n" +
+		"legacy: [gosecret|x|y]\n")
+
+	encrypted, err := EncryptTemplateTags(content, "../test_keys", "", "", DocumentBinding("values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(encrypted), "host: {{ .Values.host }} {{ if }\npassword: {{- goDecrypt \"db\" ") ||
+		!strings.HasSuffix(string(encrypted), "\"values.yaml#0\" -}}\nlegacy: [gosecret|x|y]\n") {
+		t.Fatalf("unexpected encryption %q", encrypted)
+	}
+
+	decrypted, err := DecryptTemplateTags(encrypted, "../test_keys", "", "", DocumentBinding("values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "host: {{ .Values.host }} {{ if }\npassword:hunter2legacy: [gosecret|x|y]\n" {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+
+	if _, err := DecryptTemplateTags(encrypted, "../test_keys", "", "", nil); err == nil {
+		t.Error("expected a bound tag to require its context")
+	}
+}
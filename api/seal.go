@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A seal is a tag of the form {{goSeal "keyname" "mac"}} on the last line of a document.  The MAC is an
+// HMAC-SHA256, under a key derived from the named keystore key, of everything that precedes the seal.  It
+// authenticates the whole document, including the plaintext portions and the ciphertext of every tag,
+// which the tags themselves cannot do.
+var sealRegex = regexp.MustCompile(`\{\{goSeal ("(?:[^"\\]|\\.)*") "([A-Za-z0-9+/=]*)"\}\}\n?\z`)
+
+var sealMarker = []byte("{{goSeal ")
+
+// ErrNotSealed is returned by VerifySeal when a seal is required but the document does not have one.
+var ErrNotSealed = errors.New("document is not sealed")
+
+// Compute the seal MAC of content under the key named keyname.
+func sealMAC(content, key []byte, keyname string) []byte {
+	// Derive a dedicated sealing key so that the keystore key is never used directly for two purposes.
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("gosecret seal"))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(keyname))
+	mac.Write([]byte{0})
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+// Check that the key named keyname may seal documents.  A seal is only as trustworthy as its key is secret, and
+// anyone can wrap a new data key to an age or OpenPGP recipient, so a key name naming its own wrapped data key
+// may not seal documents unless its backend holds the master key, as a KMS or transit key service does.
+// Keystore keys may always seal documents, whatever their key files hold.
+func checkSealKey(keyname string) error {
+	if _, scheme, _, ok := backendFor(keyname); ok && scheme != KMSScheme && scheme != TransitScheme {
+		return fmt.Errorf("key %s cannot seal documents; only keystore, KMS and transit keys can", keyname)
+	}
+	return nil
+}
+
+// SealDocument appends a seal to content, authenticating all of it with the key named keyname in keyroot.
+// Any existing seal is replaced.  Sealing should be the last step when encrypting a document, as any later
+// change to the document, including encrypting or rotating tags, invalidates the seal.  Keys of the age and
+// OpenPGP backends cannot seal documents, since anyone can create one.
+func SealDocument(content []byte, keyname, keyroot string) ([]byte, error) {
+	content, _ = RemoveSeal(content)
+
+	if err := checkSealKey(keyname); err != nil {
+		return nil, err
+	}
+	keyname, err := DataKeyName(keyname)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readKey(keyroot, keyname)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	sealed := make([]byte, 0, len(content)+len(keyname)+64)
+	sealed = append(sealed, content...)
+	if len(sealed) > 0 && sealed[len(sealed)-1] != '\n' {
+		sealed = append(sealed, '\n')
+	}
+	mac := sealMAC(sealed, key.Bytes(), keyname)
+	sealed = append(sealed, fmt.Sprintf("{{goSeal %s %q}}\n", strconv.Quote(keyname), base64.StdEncoding.EncodeToString(mac))...)
+
+	return sealed, nil
+}
+
+// RemoveSeal returns content without its seal, if it has one, without verifying it.
+func RemoveSeal(content []byte) ([]byte, bool) {
+	loc := sealRegex.FindIndex(content)
+	if loc == nil {
+		return content, false
+	}
+	return content[:loc[0]], true
+}
+
+// VerifySeal checks the seal of content using keys from keyroot and returns the content without its seal.
+// If the document has no seal, the content is returned unchanged, unless required is true, in which case
+// ErrNotSealed is returned.  An error is returned if the seal does not authenticate the document, if a seal
+// appears anywhere other than on the last line, or if the seal names a key of the age or OpenPGP backends.
+func VerifySeal(content []byte, keyroot string, required bool) ([]byte, error) {
+	return VerifySealKeys(content, keyroot, required, nil)
+}
+
+// VerifySealKeys behaves like VerifySeal, but if keynames is not empty, the seal must also name a key matching
+// one of its path.Match patterns, so that a document cannot choose the key that authenticates it.
+func VerifySealKeys(content []byte, keyroot string, required bool, keynames []string) ([]byte, error) {
+	match := sealRegex.FindSubmatchIndex(content)
+	if match == nil {
+		if bytes.Contains(content, sealMarker) {
+			return nil, errors.New("document seal is malformed or not on the last line")
+		}
+		if required {
+			return nil, ErrNotSealed
+		}
+		return content, nil
+	}
+
+	unsealed := content[:match[0]]
+	if bytes.Contains(unsealed, sealMarker) {
+		return nil, errors.New("document contains more than one seal")
+	}
+
+	keyname, err := strconv.Unquote(string(content[match[2]:match[3]]))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSealKey(keyname); err != nil {
+		return nil, err
+	}
+	if !matchesAny(keyname, keynames) {
+		return nil, fmt.Errorf("document is sealed with key %s, which is not one of %s", keyname, strings.Join(keynames, ", "))
+	}
+	mac, err := base64.StdEncoding.DecodeString(string(content[match[4]:match[5]]))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := readKey(keyroot, keyname)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	if !hmac.Equal(mac, sealMAC(unsealed, key.Bytes(), keyname)) {
+		return nil, errors.New("document seal does not match; the document has been modified")
+	}
+
+	return unsealed, nil
+}
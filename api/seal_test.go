@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"filippo.io/age"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestSealRoundTrip(t *testing.T) {
+	file, err := ioutil.ReadFile(path.Join("../test_data", "config_enc.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealDocument(file, "myteamkey-2014-09-19", "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsealed, err := VerifySeal(sealed, "../test_keys", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(unsealed, file) {
+		t.Errorf("expected seal to be removed, got %q", unsealed)
+	}
+
+	// Resealing replaces the existing seal rather than adding another.
+	resealed, err := SealDocument(sealed, "myteamkey-2014-09-19", "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifySeal(resealed, "../test_keys", true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealDetectsTampering(t *testing.T) {
+	content := []byte("host: db1.example.com\npassword: [gosecret|db|ZtRQbt6oLNMpuERuMKsGUd1z7jD22vfJQVHaINuTt6N/HAGBlbgHPD1pLbY=|kLTeR8rWW/sJOWcq|myteamkey-2014-09-19]\n")
+
+	sealed, err := SealDocument(content, "myteamkey-2014-09-19", "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Replace(sealed, []byte("db1.example.com"), []byte("evil.example.com"), 1)
+	if _, err := VerifySeal(tampered, "../test_keys", false); err == nil {
+		t.Error("expected modified plaintext to break the seal")
+	}
+
+	appended := append(append([]byte{}, sealed...), "debug: true\n"...)
+	if _, err := VerifySeal(appended, "../test_keys", false); err == nil {
+		t.Error("expected content after the seal to be rejected")
+	}
+
+	if _, err := VerifySeal(content, "../test_keys", true); err != ErrNotSealed {
+		t.Errorf("expected ErrNotSealed, got %v", err)
+	}
+	if unsealed, err := VerifySeal(content, "../test_keys", false); err != nil || !bytes.Equal(unsealed, content) {
+		t.Error("expected unsealed document to be accepted when a seal is not required")
+	}
+}
+
+func TestSealRejectsPublicKeys(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterKeyBackend(AgeScheme, NewAgeBackend(identity))
+	defer RegisterKeyBackend(AgeScheme, nil)
+
+	content := []byte("host: db1.example.com\n")
+	recipient := AgeScheme + ":" + identity.Recipient().String()
+	if _, err := SealDocument(content, recipient, ""); err == nil {
+		t.Error("expected an age key to be refused for sealing")
+	}
+
+	sealed, err := SealDocument(content, "myteamkey-2014-09-19", "../test_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anyone can wrap a new data key to the verifier's age recipient and reseal a modified document with it.
+	keyname, err := DataKeyName(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := readKey("", keyname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Destroy()
+	forged := []byte("host: evil.example.com\n")
+	mac := sealMAC(forged, key.Bytes(), keyname)
+	forged = append(forged, fmt.Sprintf("{{goSeal %s %q}}\n", strconv.Quote(keyname), base64.StdEncoding.EncodeToString(mac))...)
+	if _, err := VerifySeal(forged, "../test_keys", true); err == nil {
+		t.Error("expected a document resealed with an age key to be rejected")
+	}
+
+	if _, err := VerifySealKeys(sealed, "../test_keys", true, []string{"myteamkey-*"}); err != nil {
+		t.Errorf("expected a seal with a pinned key to be accepted: %v", err)
+	}
+	if _, err := VerifySealKeys(sealed, "../test_keys", true, []string{"otherkey"}); err == nil {
+		t.Error("expected a seal with a key that is not pinned to be rejected")
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"runtime"
+)
+
+// A SecureBuffer holds key or plaintext material outside the garbage collected heap where the platform allows,
+// in memory locked so that it is not swapped to disk, until Destroy zeroes and releases it.  Where memory
+// cannot be locked, as when RLIMIT_MEMLOCK is exhausted, the buffer is allocated normally and is still zeroed
+// by Destroy.  To keep secrets out of memory that is never cleared, do not convert a SecureBuffer's contents
+// to a string.
+type SecureBuffer struct {
+	mem    []byte
+	data   []byte
+	locked bool
+}
+
+// NewSecureBuffer returns a zeroed SecureBuffer of size bytes.
+func NewSecureBuffer(size int) *SecureBuffer {
+	mem, locked := allocLocked(size)
+	return &SecureBuffer{mem: mem, data: mem, locked: locked}
+}
+
+// NewSecureBufferFrom returns a SecureBuffer holding a copy of b.  The caller should Wipe b if it owns it.
+func NewSecureBufferFrom(b []byte) *SecureBuffer {
+	s := NewSecureBuffer(len(b))
+	copy(s.data, b)
+	return s
+}
+
+// Bytes returns the contents of the buffer, which are valid until Destroy is called.
+func (s *SecureBuffer) Bytes() []byte {
+	return s.data
+}
+
+// Locked reports whether the buffer is in locked memory.
+func (s *SecureBuffer) Locked() bool {
+	return s.locked
+}
+
+// Destroy zeroes the buffer and releases its memory.  The buffer must not be used afterwards.  Destroying a
+// nil or already destroyed buffer does nothing.
+func (s *SecureBuffer) Destroy() {
+	if s == nil || s.mem == nil {
+		return
+	}
+	Wipe(s.mem)
+	if s.locked {
+		freeLocked(s.mem)
+	}
+	s.mem, s.data = nil, nil
+}
+
+// Destroy each of buffers, which may include nil buffers.
+func destroyAll(buffers []*SecureBuffer) {
+	for _, b := range buffers {
+		b.Destroy()
+	}
+}
+
+// Shorten the buffer's contents to n bytes, zeroing the rest.
+func (s *SecureBuffer) truncate(n int) {
+	Wipe(s.data[n:])
+	s.data = s.data[:n]
+}
+
+// Wipe overwrites b with zeroes.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package api
+
+// Memory is only locked on Unix; elsewhere buffers are allocated normally and only zeroed.
+func allocLocked(size int) ([]byte, bool) {
+	return make([]byte, size), false
+}
+
+func freeLocked(mem []byte) {}
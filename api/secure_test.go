@@ -0,0 +1,53 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecureBuffer(t *testing.T) {
+	source := []byte("hunter2")
+	s := NewSecureBufferFrom(source)
+	if !bytes.Equal(s.Bytes(), source) {
+		t.Errorf("expected %q, got %q", source, s.Bytes())
+	}
+	s.truncate(4)
+	if string(s.Bytes()) != "hunt" {
+		t.Errorf("expected the buffer to be truncated, got %q", s.Bytes())
+	}
+	s.Destroy()
+	s.Destroy()
+	if s.Bytes() != nil {
+		t.Error("expected a destroyed buffer to be empty")
+	}
+
+	Wipe(source)
+	if !bytes.Equal(source, make([]byte, 7)) {
+		t.Errorf("expected %q to be wiped", source)
+	}
+
+	if empty := NewSecureBuffer(0); len(empty.Bytes()) != 0 {
+		t.Error("expected an empty buffer")
+	} else {
+		empty.Destroy()
+	}
+}
+
+func TestReadKeySecure(t *testing.T) {
+	key, err := readKey("../test_keys", "myteamkey-2014-09-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Destroy()
+	copied, err := ReadKey("../test_keys", "myteamkey-2014-09-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != 32 || !bytes.Equal(copied, key.Bytes()) {
+		t.Errorf("expected ReadKey to return a copy of the key")
+	}
+	Wipe(copied)
+	if bytes.Equal(copied, key.Bytes()) {
+		t.Error("expected wiping the copy to leave the key intact")
+	}
+}
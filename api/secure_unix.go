@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package api
+
+import "golang.org/x/sys/unix"
+
+// Allocate size bytes of locked memory with mmap, so that the buffer has pages of its own that can be unlocked
+// and unmapped independently.  If memory cannot be mapped or locked, an ordinary slice is returned instead.
+func allocLocked(size int) ([]byte, bool) {
+	if size == 0 {
+		return make([]byte, 0), false
+	}
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return make([]byte, size), false
+	}
+	if err := unix.Mlock(mem); err != nil {
+		unix.Munmap(mem)
+		return make([]byte, size), false
+	}
+	return mem, true
+}
+
+// Unlock and unmap memory returned by allocLocked.
+func freeLocked(mem []byte) {
+	unix.Munlock(mem)
+	unix.Munmap(mem)
+}
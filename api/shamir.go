@@ -0,0 +1,214 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Share is one piece of a key that has been split with Shamir's secret sharing scheme.  Any Threshold
+// shares produced by the same call to SplitKey can be combined to recover the original key; fewer than
+// Threshold shares reveal nothing about it.
+type Share struct {
+	KeyName   string
+	Threshold int
+	Index     byte
+	Data      []byte
+	KeyCheck  []byte
+}
+
+// GF(2^8) exponent and logarithm tables using the AES polynomial x^8 + x^4 + x^3 + x + 1 and generator 3.
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// Multiply x by the generator 3, i.e. x ^ (x * 2).
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// Compute a check value for a key so that shares of different keys, or a bad reconstruction, can be detected.
+// The check value is a truncated HMAC and reveals nothing useful about the key.
+func keyCheckValue(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gosecret key check"))
+	return mac.Sum(nil)[:4]
+}
+
+// SplitKey splits key into n shares such that any m of them can be combined with CombineShares to recover it.
+// n must be at most 255 and m must be between 2 and n.  The key name is recorded in each share so that the
+// reconstructed key can be written back under its original name.
+func SplitKey(key []byte, keyname string, n, m int) ([]Share, error) {
+	if len(key) == 0 {
+		return nil, errors.New("cannot split an empty key")
+	}
+	if n < 2 || n > 255 {
+		return nil, fmt.Errorf("number of shares must be between 2 and 255, got %d", n)
+	}
+	if m < 2 || m > n {
+		return nil, fmt.Errorf("threshold must be between 2 and %d, got %d", n, m)
+	}
+
+	kcv := keyCheckValue(key)
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{keyname, m, byte(i + 1), make([]byte, len(key)), kcv}
+	}
+
+	// Each byte of the key is the constant term of its own random polynomial of degree m-1.
+	coefficients := make([]byte, m)
+	for b, secret := range key {
+		copy(coefficients[1:], createRandomBytes(m-1))
+		coefficients[0] = secret
+		for i := range shares {
+			x := shares[i].Index
+			// Horner's method, starting from the highest degree coefficient.
+			var y byte
+			for c := m - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i].Data[b] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares recovers a key from at least Threshold shares produced by SplitKey.  All shares must belong
+// to the same key, and the recovered key is verified against the key check value recorded in the shares.
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares provided")
+	}
+
+	first := shares[0]
+	if first.Threshold < 2 || first.Threshold > 255 {
+		return nil, fmt.Errorf("invalid threshold %d; must be between 2 and 255", first.Threshold)
+	}
+	seen := make(map[byte]bool)
+	var unique []Share
+	for _, s := range shares {
+		if s.KeyName != first.KeyName || s.Threshold != first.Threshold ||
+			len(s.Data) != len(first.Data) || !hmac.Equal(s.KeyCheck, first.KeyCheck) {
+			return nil, fmt.Errorf("share %d does not belong to the same key as share %d", s.Index, first.Index)
+		}
+		if s.Index == 0 {
+			return nil, errors.New("share index must not be zero")
+		}
+		if !seen[s.Index] {
+			seen[s.Index] = true
+			unique = append(unique, s)
+		}
+	}
+
+	if len(unique) < first.Threshold {
+		return nil, fmt.Errorf("need %d distinct shares to recover key %s, got %d",
+			first.Threshold, first.KeyName, len(unique))
+	}
+	unique = unique[:first.Threshold]
+
+	// Lagrange interpolation at x = 0.
+	key := make([]byte, len(first.Data))
+	for i, si := range unique {
+		basis := byte(1)
+		for j, sj := range unique {
+			if i != j {
+				basis = gfMul(basis, gfDiv(sj.Index, sj.Index^si.Index))
+			}
+		}
+		for b := range key {
+			key[b] ^= gfMul(si.Data[b], basis)
+		}
+	}
+
+	if !hmac.Equal(keyCheckValue(key), first.KeyCheck) {
+		return nil, errors.New("recovered key does not match key check value; shares are corrupt")
+	}
+
+	return key, nil
+}
+
+// Compute the checksum of the encoded fields of a share.
+func shareChecksum(fields []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(sum[:4])
+}
+
+// String encodes the share in a copy-pasteable form of
+// [gosecret-share|keyname|threshold|index|data|keycheck|checksum], where data is Base64 and the checksum
+// guards against transcription errors.
+func (s Share) String() string {
+	fields := []string{
+		"gosecret-share",
+		s.KeyName,
+		strconv.Itoa(s.Threshold),
+		strconv.Itoa(int(s.Index)),
+		base64.StdEncoding.EncodeToString(s.Data),
+		hex.EncodeToString(s.KeyCheck),
+	}
+	return "[" + strings.Join(fields, "|") + "|" + shareChecksum(fields) + "]"
+}
+
+// ParseShare decodes a share previously encoded with Share.String, verifying its checksum.
+func ParseShare(encoded string) (Share, error) {
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, "[gosecret-share|") || !strings.HasSuffix(encoded, "]") {
+		return Share{}, errors.New("not a gosecret share")
+	}
+
+	parts := strings.Split(encoded[1:len(encoded)-1], "|")
+	if len(parts) != 7 {
+		return Share{}, fmt.Errorf("expected 7 share fields, got %d", len(parts))
+	}
+	if shareChecksum(parts[:6]) != parts[6] {
+		return Share{}, errors.New("share checksum mismatch")
+	}
+
+	threshold, err := strconv.Atoi(parts[2])
+	if err != nil || threshold < 2 || threshold > 255 {
+		return Share{}, fmt.Errorf("invalid threshold %q", parts[2])
+	}
+	index, err := strconv.Atoi(parts[3])
+	if err != nil || index < 1 || index > 255 {
+		return Share{}, fmt.Errorf("invalid share index %q", parts[3])
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Share{}, err
+	}
+	kcv, err := hex.DecodeString(parts[5])
+	if err != nil {
+		return Share{}, err
+	}
+
+	return Share{parts[1], threshold, byte(index), data, kcv}, nil
+}
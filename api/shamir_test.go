@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"path"
+	"testing"
+)
+
+func TestSplitAndCombineKey(t *testing.T) {
+	key := CreateKey()
+
+	shares, err := SplitKey(key, "myteamkey", 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares, got %d", len(shares))
+	}
+
+	// Every combination of three shares must recover the key.
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				recovered, err := CombineShares([]Share{shares[k], shares[i], shares[j]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(key, recovered) {
+					t.Errorf("shares %d, %d, %d did not recover the key", i, j, k)
+				}
+			}
+		}
+	}
+
+	if _, err := CombineShares(shares[:2]); err == nil {
+		t.Error("expected two shares to be insufficient")
+	}
+
+	// Duplicate shares must not count towards the threshold.
+	if _, err := CombineShares([]Share{shares[0], shares[0], shares[1]}); err == nil {
+		t.Error("expected duplicate shares to be rejected")
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	key, err := ReadKey(path.Clean("../test_keys"), "myteamkey-2014-09-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := SplitKey(key, "myteamkey-2014-09-19", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed []Share
+	for _, s := range shares[1:] {
+		p, err := ParseShare(s.String() + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, p)
+	}
+
+	recovered, err := CombineShares(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, recovered) {
+		t.Error("round-trip through encoded shares failed")
+	}
+
+	encoded := []byte(shares[0].String())
+	encoded[len(encoded)-12] ^= 1
+	if _, err := ParseShare(string(encoded)); err == nil {
+		t.Error("expected corrupted share to fail its checksum")
+	}
+}
+
+func TestCombineSharesOfDifferentKeys(t *testing.T) {
+	a, _ := SplitKey(CreateKey(), "myteamkey", 3, 2)
+	b, _ := SplitKey(CreateKey(), "myteamkey", 3, 2)
+
+	if _, err := CombineShares([]Share{a[0], b[1]}); err == nil {
+		t.Error("expected shares of different keys to be rejected")
+	}
+}
+
+func TestInvalidThreshold(t *testing.T) {
+	shares, _ := SplitKey(CreateKey(), "myteamkey", 3, 2)
+	for _, threshold := range []int{-1, 0, 1, 256} {
+		s := shares[0]
+		s.Threshold = threshold
+		if _, err := ParseShare(s.String()); err == nil {
+			t.Errorf("expected threshold %d to be rejected", threshold)
+		}
+		invalid := []Share{s, shares[1], shares[2]}
+		for i := range invalid {
+			invalid[i].Threshold = threshold
+		}
+		if _, err := CombineShares(invalid); err == nil {
+			t.Errorf("expected shares with threshold %d to be rejected", threshold)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package api
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SOPS document formats ImportSOPS and ExportSOPS read and write.
+const (
+	SOPSJSON = "json"
+	SOPSYAML = "yaml"
+)
+
+// The SOPS version recorded in exported documents, and the key suffix marking values SOPS leaves unencrypted.
+const (
+	sopsVersion           = "3.8.1"
+	sopsUnencryptedSuffix = "_unencrypted"
+)
+
+// SOPS encrypts each value with AES-256-GCM, using a 32 byte nonce and the value's path as authenticated data.
+var sopsValueRegex = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]*),tag:([^,]*),type:([^,\]]*)\]$`)
+
+// The sops metadata entry of a SOPS document, holding the document's data key encrypted to each recipient.
+// Entries for other kinds of keys, such as KMS keys, are ignored.
+type sopsMetadata struct {
+	Age               []sopsAgeEntry `yaml:"age,omitempty"`
+	LastModified      string         `yaml:"lastmodified"`
+	MAC               string         `yaml:"mac"`
+	MACOnlyEncrypted  bool           `yaml:"mac_only_encrypted,omitempty"`
+	PGP               []sopsPGPEntry `yaml:"pgp,omitempty"`
+	UnencryptedSuffix string         `yaml:"unencrypted_suffix,omitempty"`
+	Version           string         `yaml:"version"`
+}
+
+type sopsAgeEntry struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+type sopsPGPEntry struct {
+	CreatedAt   string `yaml:"created_at"`
+	Enc         string `yaml:"enc"`
+	Fingerprint string `yaml:"fp"`
+}
+
+// SOPSRecipients are the keys a document written by ExportSOPS is encrypted to.
+type SOPSRecipients struct {
+	// Age holds age X25519 recipients, such as age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p.
+	Age []string
+	// PGP holds OpenPGP public keys.
+	PGP openpgp.EntityList
+}
+
+// ImportSOPS converts a SOPS encrypted JSON or YAML document, as format names, into a gosecret document in the
+// same format.  The document's data key is decrypted with the registered age or OpenPGP key backend, and its
+// MAC is verified.  Each value SOPS encrypted is replaced by a template tag encrypted with the key named
+// keyname, whose auth data is the value's path with its keys separated by dots and whose plaintext is the value
+// as written in JSON, quotes included, so that decrypting the tags reproduces the SOPS plaintext, types intact.
+// Values SOPS left unencrypted are copied as they are, and the sops metadata is dropped.
+func ImportSOPS(content []byte, format, keyname, keyroot string) ([]byte, error) {
+	if format != SOPSJSON && format != SOPSYAML {
+		return nil, fmt.Errorf("unknown SOPS format %q", format)
+	}
+	document, err := parseSOPSDocument(content)
+	if err != nil {
+		return nil, err
+	}
+	metadata, document, err := splitSOPSMetadata(document)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, errors.New("not a SOPS document: there is no sops metadata")
+	}
+	key, err := metadata.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	hash := sha512.New()
+	prefix := "gosecret-sops-" + hex.EncodeToString(createRandomBytes(8)) + "-"
+	tags := make(map[string]string)
+	_, err = walkSOPSTree(document, nil, func(value interface{}, path []string) (interface{}, error) {
+		s, ok := value.(string)
+		encrypted := ok && sopsValueRegex.MatchString(s)
+		if encrypted {
+			var err error
+			value, err = decryptSOPSValue(s, key, strings.Join(path, ":")+":")
+			if err != nil {
+				return nil, fmt.Errorf("unable to decrypt %s: %v", strings.Join(path, "."), err)
+			}
+		}
+		if encrypted || !metadata.MACOnlyEncrypted {
+			hash.Write(sopsMACBytes(value))
+		}
+		if !encrypted {
+			return value, nil
+		}
+
+		scalar, err := jsonScalar(value)
+		if err != nil {
+			return nil, err
+		}
+		tag, err := Tag{Format: TemplateFormat, AuthData: strings.Join(path, "."), Plaintext: scalar}.Encrypt(keyname, keyroot, "")
+		if err != nil {
+			return nil, err
+		}
+		placeholder := prefix + strconv.Itoa(len(tags)) + "x"
+		tags[placeholder] = tag.String()
+		return placeholder, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := decryptSOPSValue(metadata.MAC, key, metadata.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the document's MAC: %v", err)
+	}
+	if mac != fmt.Sprintf("%X", hash.Sum(nil)) {
+		return nil, errors.New("the document's MAC does not match its values; it has been modified since SOPS encrypted it")
+	}
+
+	out, err := marshalSOPSDocument(document, format)
+	if err != nil {
+		return nil, err
+	}
+	for placeholder, tag := range tags {
+		if format == SOPSJSON {
+			placeholder = strconv.Quote(placeholder)
+		}
+		out = bytes.Replace(out, []byte(placeholder), []byte(tag), 1)
+	}
+	return out, nil
+}
+
+// ExportSOPS converts a gosecret JSON or YAML document, as format names, into a SOPS encrypted document that
+// the recipients can decrypt with SOPS.  The legacy and template tags in content are decrypted with keys from
+// keyroot first, and must not be bound; then, as SOPS does by default, every value is encrypted except those
+// under a key ending in _unencrypted.
+func ExportSOPS(content []byte, format, keyroot string, recipients SOPSRecipients) ([]byte, error) {
+	if format != SOPSJSON && format != SOPSYAML {
+		return nil, fmt.Errorf("unknown SOPS format %q", format)
+	}
+	if len(recipients.Age) == 0 && len(recipients.PGP) == 0 {
+		return nil, errors.New("a SOPS document needs at least one age or OpenPGP recipient")
+	}
+
+	plaintext, err := DecryptTags(content, keyroot)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err = DecryptTemplateTags(plaintext, keyroot, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	document, err := parseSOPSDocument(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("the decrypted document is not valid %s: %v", strings.ToUpper(format), err)
+	}
+	if metadata, _, err := splitSOPSMetadata(document); err != nil || metadata != nil {
+		return nil, errors.New("the document already has sops metadata")
+	}
+
+	key := CreateKey()
+	hash := sha512.New()
+	_, err = walkSOPSTree(document, nil, func(value interface{}, path []string) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		hash.Write(sopsMACBytes(value))
+		for _, k := range path {
+			if strings.HasSuffix(k, sopsUnencryptedSuffix) {
+				return value, nil
+			}
+		}
+		return encryptSOPSValue(value, key, strings.Join(path, ":")+":")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := sopsMetadata{
+		LastModified:      time.Now().UTC().Format(time.RFC3339),
+		UnencryptedSuffix: sopsUnencryptedSuffix,
+		Version:           sopsVersion,
+	}
+	metadata.MAC, err = encryptSOPSValue(fmt.Sprintf("%X", hash.Sum(nil)), key, metadata.LastModified)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range recipients.Age {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := ageArmoredKey(key, recipient)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Age = append(metadata.Age, sopsAgeEntry{Recipient: r, Enc: enc})
+	}
+	for _, entity := range recipients.PGP {
+		enc, err := pgpArmoredKey(key, entity)
+		if err != nil {
+			return nil, err
+		}
+		metadata.PGP = append(metadata.PGP, sopsPGPEntry{
+			CreatedAt:   metadata.LastModified,
+			Enc:         enc,
+			Fingerprint: strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])),
+		})
+	}
+
+	// Round trip the metadata through YAML so that it is written like the rest of the document.
+	marshaled, err := yaml.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var sops yaml.MapSlice
+	if err := yaml.Unmarshal(marshaled, &sops); err != nil {
+		return nil, err
+	}
+	document = append(document, yaml.MapItem{Key: "sops", Value: sops})
+	return marshalSOPSDocument(document, format)
+}
+
+// Parse a JSON or YAML document, keeping the order of its keys.  JSON is parsed as YAML, of which it is a subset.
+func parseSOPSDocument(content []byte) (yaml.MapSlice, error) {
+	var document yaml.MapSlice
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// Separate the sops metadata from the rest of a document, returning nil metadata if there is none.
+func splitSOPSMetadata(document yaml.MapSlice) (*sopsMetadata, yaml.MapSlice, error) {
+	for i, item := range document {
+		if item.Key != "sops" {
+			continue
+		}
+		marshaled, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		var metadata sopsMetadata
+		if err := yaml.Unmarshal(marshaled, &metadata); err != nil {
+			return nil, nil, fmt.Errorf("malformed sops metadata: %v", err)
+		}
+		rest := append(yaml.MapSlice{}, document[:i]...)
+		return &metadata, append(rest, document[i+1:]...), nil
+	}
+	return nil, document, nil
+}
+
+// Decrypt a document's data key with the age or OpenPGP key backend, trying each recipient's copy in turn.
+func (m *sopsMetadata) dataKey() ([]byte, error) {
+	var failures []string
+	for _, entry := range m.Age {
+		file, err := ioutil.ReadAll(armor.NewReader(strings.NewReader(entry.Enc)))
+		if err == nil {
+			var key []byte
+			if key, err = unwrapSOPSKey(AgeScheme, file); err == nil {
+				return key, nil
+			}
+		}
+		failures = append(failures, fmt.Sprintf("age recipient %s: %v", entry.Recipient, err))
+	}
+	for _, entry := range m.PGP {
+		block, err := pgparmor.Decode(strings.NewReader(entry.Enc))
+		if err == nil {
+			var message []byte
+			if message, err = ioutil.ReadAll(block.Body); err == nil {
+				var key []byte
+				if key, err = unwrapSOPSKey(PGPScheme, message); err == nil {
+					return key, nil
+				}
+			}
+		}
+		failures = append(failures, fmt.Sprintf("OpenPGP key %s: %v", entry.Fingerprint, err))
+	}
+	if len(failures) == 0 {
+		return nil, errors.New("the document's data key is not encrypted to any age or OpenPGP key")
+	}
+	return nil, errors.New("unable to decrypt the document's data key; " + strings.Join(failures, "; "))
+}
+
+// Decrypt a copy of a data key with the key backend registered for scheme, which records such copies Base64
+// encoded.
+func unwrapSOPSKey(scheme string, message []byte) ([]byte, error) {
+	backend, _, ref, ok := backendFor(scheme + ":" + base64.StdEncoding.EncodeToString(message))
+	if !ok {
+		return nil, fmt.Errorf("no %s key backend is registered", scheme)
+	}
+	return backend.UnwrapKey(ref)
+}
+
+// Encrypt key to an age recipient, as an armored age file.
+func ageArmoredKey(key []byte, recipient age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipient)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(key); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Encrypt key to an OpenPGP key, as an armored OpenPGP message.
+func pgpArmoredKey(key []byte, entity *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	aw, err := pgparmor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	w, err := openpgp.Encrypt(aw, openpgp.EntityList{entity}, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(key); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n") + "\n", nil
+}
+
+// Call visit for each scalar in a document tree, in document order, with the keys leading to it, replacing the
+// scalar with the value visit returns.  Like SOPS, items of a list share the list's path.
+func walkSOPSTree(value interface{}, path []string, visit func(interface{}, []string) (interface{}, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			child, err := walkSOPSTree(item.Value, append(path[:len(path):len(path)], fmt.Sprint(item.Key)), visit)
+			if err != nil {
+				return nil, err
+			}
+			v[i].Value = child
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			child, err := walkSOPSTree(item, path, visit)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = child
+		}
+		return v, nil
+	}
+	return visit(value, path)
+}
+
+// Return the bytes of a value SOPS includes in a document's MAC.
+func sopsMACBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case bool:
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return []byte(fmt.Sprint(value))
+}
+
+func sopsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, 32)
+}
+
+// Encrypt a scalar as SOPS does, recording its type so that it can be restored.
+func encryptSOPSValue(value interface{}, key []byte, ad string) (string, error) {
+	var plaintext, valueType string
+	switch v := value.(type) {
+	case string:
+		plaintext, valueType = v, "str"
+	case int, int64, uint64:
+		plaintext, valueType = fmt.Sprint(v), "int"
+	case float64:
+		plaintext, valueType = strconv.FormatFloat(v, 'f', -1, 64), "float"
+	case bool:
+		// SOPS writes booleans capitalized, as in its MAC.
+		plaintext, valueType = string(sopsMACBytes(v)), "bool"
+	default:
+		return "", fmt.Errorf("cannot encrypt a value of type %T", value)
+	}
+
+	aead, err := sopsCipher(key)
+	if err != nil {
+		return "", err
+	}
+	iv := createRandomBytes(32)
+	sealed := aead.Seal(nil, iv, []byte(plaintext), []byte(ad))
+	data, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(tag), valueType), nil
+}
+
+// Decrypt a value SOPS encrypted, restoring its type.
+func decryptSOPSValue(s string, key []byte, ad string) (interface{}, error) {
+	parts := sopsValueRegex.FindStringSubmatch(s)
+	if parts == nil {
+		return nil, errors.New("malformed SOPS encrypted value")
+	}
+	var fields [3][]byte
+	for i := range fields {
+		var err error
+		if fields[i], err = base64.StdEncoding.DecodeString(parts[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	data, iv, tag := fields[0], fields[1], fields[2]
+
+	aead, err := sopsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, errors.New("malformed SOPS encrypted value")
+	}
+	plaintext, err := aead.Open(nil, iv, append(data, tag...), []byte(ad))
+	if err != nil {
+		return nil, err
+	}
+
+	switch parts[4] {
+	case "str", "bytes":
+		return string(plaintext), nil
+	case "int":
+		return strconv.Atoi(string(plaintext))
+	case "float":
+		return strconv.ParseFloat(string(plaintext), 64)
+	case "bool":
+		return strconv.ParseBool(string(plaintext))
+	}
+	return nil, fmt.Errorf("unknown SOPS value type %q", parts[4])
+}
+
+// Write a document in format, keeping the order of its keys.
+func marshalSOPSDocument(document yaml.MapSlice, format string) ([]byte, error) {
+	if format == SOPSYAML {
+		return yaml.Marshal(document)
+	}
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, document, ""); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Write a document tree as JSON indented with tabs, as SOPS writes it.
+func writeJSON(buf *bytes.Buffer, value interface{}, indent string) error {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		buf.WriteString("{\n")
+		for i, item := range v {
+			key, err := jsonScalar(fmt.Sprint(item.Key))
+			if err != nil {
+				return err
+			}
+			buf.WriteString(indent + "\t")
+			buf.Write(key)
+			buf.WriteString(": ")
+			if err := writeJSON(buf, item.Value, indent+"\t"); err != nil {
+				return err
+			}
+			if i < len(v)-1 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(indent + "}")
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+		buf.WriteString("[\n")
+		for i, item := range v {
+			buf.WriteString(indent + "\t")
+			if err := writeJSON(buf, item, indent+"\t"); err != nil {
+				return err
+			}
+			if i < len(v)-1 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(indent + "]")
+	default:
+		scalar, err := jsonScalar(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(scalar)
+	}
+	return nil
+}
+
+// Encode a scalar as JSON, without escaping HTML characters.
+func jsonScalar(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
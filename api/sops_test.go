@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"filippo.io/age"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSOPSRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterKeyBackend(AgeScheme, NewAgeBackend(identity))
+	defer RegisterKeyBackend(AgeScheme, nil)
+	recipients := SOPSRecipients{Age: []string{identity.Recipient().String()}}
+
+	for _, test := range []struct {
+		format    string
+		plaintext string
+		decrypted string
+	}{
+		{SOPSJSON, "{\n\t\"db\": {\n\t\t\"user\": \"app\",\n\t\t\"password\": \"hun\\\"ter2\",\n\t\t\"port\": 5432,\n\t\t\"ratio\": 0.5,\n\t\t\"tls\": true\n\t},\n\t\"hosts\": [\n\t\t\"a\",\n\t\t\"b\"\n\t],\n\t\"note_unencrypted\": \"visible\"\n}\n", ""},
+		{SOPSYAML, "db:\n  user: app\n  password: hun\"ter2\n  port: 5432\nhosts:\n- a\n- b\nnote_unencrypted: visible\n",
+			// Strings come back in double quotes, since tags decrypt to values as written in JSON.
+			"db:\n  user: \"app\"\n  password: \"hun\\\"ter2\"\n  port: 5432\nhosts:\n- \"a\"\n- \"b\"\nnote_unencrypted: visible\n"},
+	} {
+		tagged := []byte(strings.Replace(test.plaintext, "app", "[gosecret|user|app]", 1))
+		tagged, err := EncryptTags(tagged, "myteamkey-2014-09-19", "../test_keys", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exported, err := ExportSOPS(tagged, test.format, "../test_keys", recipients)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if bytes.Contains(exported, []byte("hunter2")) || bytes.Contains(exported, []byte("app")) ||
+			!bytes.Contains(exported, []byte("visible")) || !bytes.Contains(exported, []byte("ENC[AES256_GCM,data:")) ||
+			!bytes.Contains(exported, []byte("-----BEGIN AGE ENCRYPTED FILE-----")) {
+			t.Errorf("%s: unexpected SOPS document %s", test.format, exported)
+		}
+
+		imported, err := ImportSOPS(exported, test.format, "myteamkey-2014-09-19", "../test_keys")
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if bytes.Contains(imported, []byte("sops")) || !bytes.Contains(imported, []byte("{{goDecrypt \"db.password\" ")) {
+			t.Errorf("%s: unexpected imported document %s", test.format, imported)
+		}
+		decrypted, err := DecryptTemplateTags(imported, "../test_keys", "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.decrypted == "" {
+			test.decrypted = test.plaintext
+		}
+		if string(decrypted) != test.decrypted {
+			t.Errorf("%s: expected %q, got %q", test.format, test.decrypted, decrypted)
+		}
+
+		tampered := bytes.Replace(exported, []byte("visible"), []byte("changed"), 1)
+		if _, err := ImportSOPS(tampered, test.format, "myteamkey-2014-09-19", "../test_keys"); err == nil ||
+			!strings.Contains(err.Error(), "MAC") {
+			t.Errorf("%s: expected a MAC mismatch, got %v", test.format, err)
+		}
+	}
+
+	RegisterKeyBackend(AgeScheme, NewAgeBackend())
+	exported, err := ExportSOPS([]byte("a: b\n"), SOPSYAML, "", recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportSOPS(exported, SOPSYAML, "myteamkey-2014-09-19", "../test_keys"); err == nil {
+		t.Error("expected import without an identity to fail")
+	}
+}
+
+func TestSOPSValue(t *testing.T) {
+	key := CreateKey()
+	for _, value := range []interface{}{"secret", 42, 1.5, true} {
+		encrypted, err := encryptSOPSValue(value, key, "a:b:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := decryptSOPSValue(encrypted, key, "a:b:")
+		if err != nil || decrypted != value {
+			t.Errorf("expected %v, got %v: %v", value, decrypted, err)
+		}
+		if _, err := decryptSOPSValue(encrypted, key, "a:c:"); err == nil {
+			t.Error("expected decryption at another path to fail")
+		}
+	}
+
+	// Booleans are encrypted capitalized, as SOPS writes them.
+	encrypted, err := encryptSOPSValue(true, key, "a:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := sopsValueRegex.FindStringSubmatch(encrypted)
+	data, _ := base64.StdEncoding.DecodeString(parts[1])
+	iv, _ := base64.StdEncoding.DecodeString(parts[2])
+	tag, _ := base64.StdEncoding.DecodeString(parts[3])
+	aead, err := sopsCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := aead.Open(nil, iv, append(data, tag...), []byte("a:")); err != nil || string(plaintext) != "True" {
+		t.Errorf("expected True, got %q: %v", plaintext, err)
+	}
+}
+
+// The documents under test_data/sops were not written by SOPS itself, which is unavailable to these tests, but by
+// a separate implementation of its format, encrypted to the age identity in test_keys/sops-age-identity.txt.
+func TestSOPSFixtures(t *testing.T) {
+	file, err := os.Open("../test_keys/sops-age-identity.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterKeyBackend(AgeScheme, NewAgeBackend(identities...))
+	defer RegisterKeyBackend(AgeScheme, nil)
+
+	for _, test := range []struct {
+		format    string
+		file      string
+		decrypted string
+	}{
+		{SOPSYAML, "secrets.yaml", "db:\n  user: \"app\"\n  password: \"hun\\\"ter2\"\n  port: 5432\n  ratio: 0.5\n  tls: true\nhosts:\n- \"a\"\n- \"b\"\nnote_unencrypted: visible\n"},
+		{SOPSJSON, "secrets.json", "{\n\t\"db\": {\n\t\t\"user\": \"app\",\n\t\t\"password\": \"hun\\\"ter2\",\n\t\t\"port\": 5432,\n\t\t\"ratio\": 0.5,\n\t\t\"tls\": true\n\t},\n\t\"hosts\": [\n\t\t\"a\",\n\t\t\"b\"\n\t],\n\t\"note_unencrypted\": \"visible\"\n}\n"},
+	} {
+		content, err := ioutil.ReadFile("../test_data/sops/" + test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, err := ImportSOPS(content, test.format, "myteamkey-2014-09-19", "../test_keys")
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		decrypted, err := DecryptTemplateTags(imported, "../test_keys", "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != test.decrypted {
+			t.Errorf("%s: expected %q, got %q", test.file, test.decrypted, decrypted)
+		}
+
+		tampered := bytes.Replace(content, []byte("visible"), []byte("changed"), 1)
+		if _, err := ImportSOPS(tampered, test.format, "myteamkey-2014-09-19", "../test_keys"); err == nil ||
+			!strings.Contains(err.Error(), "MAC") {
+			t.Errorf("%s: expected a MAC mismatch, got %v", test.file, err)
+		}
+	}
+}
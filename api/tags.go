@@ -0,0 +1,419 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TagFormat identifies which of the two gosecret tag syntaxes a tag was written in.
+type TagFormat int
+
+const (
+	// LegacyFormat is the deprecated [gosecret|...] syntax.
+	LegacyFormat TagFormat = iota
+	// TemplateFormat is the {{goEncrypt ...}} / {{goDecrypt ...}} template syntax.
+	TemplateFormat
+)
+
+// The delimiters template tags use unless others are given, as in text/template.
+const (
+	DefaultLeftDelim  = "{{"
+	DefaultRightDelim = "}}"
+)
+
+func (f TagFormat) String() string {
+	if f == TemplateFormat {
+		return "template"
+	}
+	return "legacy"
+}
+
+// A Tag is a gosecret tag found in a document by FindTags.  Offset and Length locate the complete tag,
+// including its delimiters, in the document; Line and Column are 1-based and count runes.  For encrypted
+// tags, CipherText, InitVector and KeyName are set, as is Context if the tag is bound to a context.  For
+// unencrypted tags, Plaintext is set, and so is KeyName for template tags, which name the key they are to be
+// encrypted with.  Template tags record the delimiters they were found with in LeftDelim and RightDelim, and
+// whether they carry the "- " and " -" white space trimming markers in TrimLeft and TrimRight.
+type Tag struct {
+	Format     TagFormat
+	Encrypted  bool
+	Offset     int
+	Length     int
+	Line       int
+	Column     int
+	AuthData   string
+	Plaintext  []byte
+	CipherText []byte
+	InitVector []byte
+	KeyName    string
+	Context    string
+	LeftDelim  string
+	RightDelim string
+	TrimLeft   bool
+	TrimRight  bool
+}
+
+// FindTags returns every well-formed gosecret tag in content, in both the legacy and template formats, in
+// the order in which they appear.  Nothing is decrypted and no key is required.  Template actions other
+// than goEncrypt and goDecrypt calls with literal string arguments are ignored, as are legacy tags with the
+// wrong number of fields and tags whose Base64 fields cannot be decoded.
+func FindTags(content []byte) []Tag {
+	return FindTagsDelims(content, "", "")
+}
+
+// FindTagsDelims is like FindTags, but finds template tags written with the given action delimiters instead of
+// {{ and }}.  Empty delimiters mean the defaults, as with text/template's Delims.
+func FindTagsDelims(content []byte, left, right string) []Tag {
+	if left == "" {
+		left = DefaultLeftDelim
+	}
+	if right == "" {
+		right = DefaultRightDelim
+	}
+
+	var tags []Tag
+
+	for _, loc := range gosecretRegex.FindAllIndex(content, -1) {
+		if tag, ok := parseLegacyTag(content[loc[0]:loc[1]]); ok {
+			tag.Offset = loc[0]
+			tag.Length = loc[1] - loc[0]
+			tags = append(tags, tag)
+		}
+	}
+
+	// Convert the content once; slicing the string for each action does not copy it.
+	text := string(content)
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], left)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		tag, length, ok := parseTemplateTag(text[start:], left, right)
+		if ok {
+			tag.Offset = start
+			tag.Length = length
+			tag.LeftDelim = left
+			tag.RightDelim = right
+			tags = insertTag(tags, tag)
+			offset = start + length
+		} else {
+			offset = start + len(left)
+		}
+	}
+
+	for i := range tags {
+		tags[i].Line, tags[i].Column = position(content, tags[i].Offset)
+	}
+
+	return tags
+}
+
+// Insert tag into tags, which is sorted by offset, keeping it sorted.
+func insertTag(tags []Tag, tag Tag) []Tag {
+	i := len(tags)
+	for i > 0 && tags[i-1].Offset > tag.Offset {
+		i--
+	}
+	tags = append(tags, Tag{})
+	copy(tags[i+1:], tags[i:])
+	tags[i] = tag
+	return tags
+}
+
+// Compute the 1-based line and column of a byte offset in content.
+func position(content []byte, offset int) (int, int) {
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return line, utf8.RuneCount(before[lineStart:]) + 1
+}
+
+// Parse a complete legacy tag, including its enclosing brackets.
+func parseLegacyTag(match []byte) (Tag, bool) {
+	parts := splitLegacyTag(match)
+
+	switch len(parts) {
+	case 3:
+		return Tag{Format: LegacyFormat, AuthData: string(parts[1]), Plaintext: append([]byte{}, parts[2]...)}, true
+	case 5, 6:
+		ct, err := decodeBase64(parts[2])
+		if err != nil {
+			return Tag{}, false
+		}
+		iv, err := decodeBase64(parts[3])
+		if err != nil {
+			return Tag{}, false
+		}
+		tag := Tag{
+			Format:     LegacyFormat,
+			Encrypted:  true,
+			AuthData:   string(parts[1]),
+			CipherText: ct,
+			InitVector: iv,
+			KeyName:    string(parts[4]),
+		}
+		if len(parts) == 6 {
+			tag.Context = string(parts[5])
+		}
+		return tag, true
+	}
+
+	return Tag{}, false
+}
+
+// Parse a template action at the start of text, returning the tag and the length of the action if it is a
+// goEncrypt or goDecrypt call whose arguments are all string literals.
+func parseTemplateTag(s string, left, right string) (Tag, int, bool) {
+	if !strings.HasPrefix(s, left) {
+		return Tag{}, 0, false
+	}
+	pos := len(left)
+	trimLeft := strings.HasPrefix(s[pos:], "- ")
+	if trimLeft {
+		pos += 2
+	}
+	pos = skipSpace(s, pos)
+
+	nameEnd := pos
+	for nameEnd < len(s) && (isIdentRune(s[nameEnd])) {
+		nameEnd++
+	}
+	name := s[pos:nameEnd]
+	if name != "goEncrypt" && name != "goDecrypt" {
+		return Tag{}, 0, false
+	}
+	pos = nameEnd
+
+	var args []string
+	trimRight := false
+	for {
+		next := skipSpace(s, pos)
+		if strings.HasPrefix(s[next:], right) {
+			pos = next + len(right)
+			break
+		}
+		if strings.HasPrefix(s[next:], "-"+right) && next > pos {
+			pos = next + 1 + len(right)
+			trimRight = true
+			break
+		}
+		if next == pos {
+			// Arguments must be separated from the function name and each other by white space.
+			return Tag{}, 0, false
+		}
+		literal, err := strconv.QuotedPrefix(s[next:])
+		if err != nil || literal[0] == '\'' {
+			return Tag{}, 0, false
+		}
+		arg, err := strconv.Unquote(literal)
+		if err != nil {
+			return Tag{}, 0, false
+		}
+		args = append(args, arg)
+		pos = next + len(literal)
+	}
+
+	if name == "goEncrypt" {
+		if len(args) != 3 {
+			return Tag{}, 0, false
+		}
+		return Tag{Format: TemplateFormat, AuthData: args[0], Plaintext: []byte(args[1]), KeyName: args[2],
+			TrimLeft: trimLeft, TrimRight: trimRight}, pos, true
+	}
+
+	if len(args) != 4 && len(args) != 5 {
+		return Tag{}, 0, false
+	}
+	ct, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return Tag{}, 0, false
+	}
+	iv, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return Tag{}, 0, false
+	}
+	tag := Tag{
+		Format:     TemplateFormat,
+		Encrypted:  true,
+		AuthData:   args[0],
+		CipherText: ct,
+		InitVector: iv,
+		KeyName:    args[3],
+		TrimLeft:   trimLeft,
+		TrimRight:  trimRight,
+	}
+	if len(args) == 5 {
+		tag.Context = args[4]
+	}
+	return tag, pos, true
+}
+
+// Decrypt returns the plaintext of a tag, decrypting it with a key from keyroot if it is encrypted.  Bound tags
+// are decrypted using their recorded context; callers that require a particular context must check Context.
+func (tag Tag) Decrypt(keyroot string) ([]byte, error) {
+	if !tag.Encrypted {
+		return tag.Plaintext, nil
+	}
+	ad := []byte(tag.AuthData)
+	if tag.Context != "" {
+		ad = boundAuthData(ad, tag.Context)
+	}
+	dt := DecryptionTag{ad, tag.CipherText, tag.InitVector, tag.KeyName}
+	return dt.DecryptTag(keyroot)
+}
+
+// DecryptSecure behaves like Decrypt, but returns the plaintext in a SecureBuffer, which the caller must
+// Destroy.
+func (tag Tag) DecryptSecure(keyroot string) (*SecureBuffer, error) {
+	return tag.decryptSecure(keyroot, nil)
+}
+
+// DecryptSecureFrom behaves like DecryptSecure, but records origin, rather than the source set by
+// SetAuditSource, in the audit log.
+func (tag Tag) DecryptSecureFrom(keyroot string, origin AuditOrigin) (*SecureBuffer, error) {
+	return tag.decryptSecure(keyroot, &origin)
+}
+
+func (tag Tag) decryptSecure(keyroot string, origin *AuditOrigin) (*SecureBuffer, error) {
+	if !tag.Encrypted {
+		return NewSecureBufferFrom(tag.Plaintext), nil
+	}
+	ad := []byte(tag.AuthData)
+	if tag.Context != "" {
+		ad = boundAuthData(ad, tag.Context)
+	}
+	dt := DecryptionTag{ad, tag.CipherText, tag.InitVector, tag.KeyName}
+	return dt.decryptTagFrom(keyroot, origin)
+}
+
+// Encrypt returns an encrypted copy of an unencrypted tag, in the same format, using the key named keyname in
+// keyroot.  If context is not empty, the encrypted tag is bound to it.
+func (tag Tag) Encrypt(keyname, keyroot, context string) (Tag, error) {
+	return tag.encrypt(keyname, keyroot, context, nil)
+}
+
+// EncryptFrom behaves like Encrypt, but records origin, rather than the source set by SetAuditSource, in the
+// audit log.
+func (tag Tag) EncryptFrom(keyname, keyroot, context string, origin AuditOrigin) (Tag, error) {
+	return tag.encrypt(keyname, keyroot, context, &origin)
+}
+
+func (tag Tag) encrypt(keyname, keyroot, context string, origin *AuditOrigin) (Tag, error) {
+	if tag.Encrypted {
+		return Tag{}, fmt.Errorf("tag %q is already encrypted", tag.AuthData)
+	}
+	if err := checkContext(context); err != nil {
+		return Tag{}, err
+	}
+
+	keyname, err := DataKeyName(keyname)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	ad := []byte(tag.AuthData)
+	if context != "" {
+		ad = boundAuthData(ad, context)
+	}
+	et := EncryptionTag{ad, tag.Plaintext, keyname}
+	iv := createIV()
+	cipherText, err := et.encryptTagFrom(keyroot, iv, origin)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	encrypted := tag
+	encrypted.Encrypted = true
+	encrypted.Plaintext = nil
+	encrypted.CipherText = cipherText
+	encrypted.InitVector = iv
+	encrypted.KeyName = keyname
+	encrypted.Context = context
+	return encrypted, nil
+}
+
+// String formats a tag in its format.  Template tags use their LeftDelim and RightDelim, or {{ and }} if
+// these are empty, and quote their arguments as Go string literals.
+func (tag Tag) String() string {
+	if tag.Format == TemplateFormat {
+		var args []string
+		name := "goEncrypt"
+		if tag.Encrypted {
+			name = "goDecrypt"
+			args = []string{tag.AuthData, base64.StdEncoding.EncodeToString(tag.CipherText),
+				base64.StdEncoding.EncodeToString(tag.InitVector), tag.KeyName}
+			if tag.Context != "" {
+				args = append(args, tag.Context)
+			}
+		} else {
+			args = []string{tag.AuthData, string(tag.Plaintext), tag.KeyName}
+		}
+		for i := range args {
+			args[i] = strconv.Quote(args[i])
+		}
+		left, right := tag.LeftDelim, tag.RightDelim
+		if left == "" {
+			left = DefaultLeftDelim
+		}
+		if right == "" {
+			right = DefaultRightDelim
+		}
+		if tag.TrimLeft {
+			left += "- "
+		}
+		if tag.TrimRight {
+			right = " -" + right
+		}
+		return left + name + " " + strings.Join(args, " ") + right
+	}
+
+	if !tag.Encrypted {
+		return "[gosecret|" + tag.AuthData + "|" + string(tag.Plaintext) + "]"
+	}
+	parts := []string{"gosecret", tag.AuthData, base64.StdEncoding.EncodeToString(tag.CipherText),
+		base64.StdEncoding.EncodeToString(tag.InitVector), tag.KeyName}
+	if tag.Context != "" {
+		parts = append(parts, tag.Context)
+	}
+	return "[" + strings.Join(parts, "|") + "]"
+}
+
+// ReplaceTags returns a copy of content in which each of tags, as returned by FindTags for content, is replaced
+// by the bytes returned by replace for it.  Everything else in content is copied unchanged.  The first error
+// returned by replace is returned.
+func ReplaceTags(content []byte, tags []Tag, replace func(Tag) ([]byte, error)) ([]byte, error) {
+	var buf bytes.Buffer
+	last := 0
+	for _, tag := range tags {
+		if tag.Offset < last {
+			// A legacy tag inside the arguments of a template tag is replaced along with the template tag.
+			continue
+		}
+		replacement, err := replace(tag)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(content[last:tag.Offset])
+		buf.Write(replacement)
+		last = tag.Offset + tag.Length
+	}
+	buf.Write(content[last:])
+	return buf.Bytes(), nil
+}
+
+func skipSpace(s string, pos int) int {
+	for pos < len(s) && unicode.IsSpace(rune(s[pos])) {
+		pos++
+	}
+	return pos
+}
+
+func isIdentRune(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
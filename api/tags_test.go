@@ -0,0 +1,114 @@
+package api
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFindTagsHybrid(t *testing.T) {
+	file, err := ioutil.ReadFile(path.Join("../test_data/template", "encrypted_hybrid.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := FindTags(file)
+	if len(tags) != 2 {
+		t.Fatalf("expected 2 tags, got %d", len(tags))
+	}
+
+	if tags[0].Format != TemplateFormat || !tags[0].Encrypted || tags[0].AuthData != "MySql Password" ||
+		tags[0].KeyName != "myteamkey-2014-09-19" || tags[0].Line != 2 || tags[0].Column != 19 {
+		t.Errorf("unexpected template tag %+v", tags[0])
+	}
+	if len(tags[0].InitVector) != 12 {
+		t.Errorf("expected 12 byte IV, got %d", len(tags[0].InitVector))
+	}
+
+	if tags[1].Format != LegacyFormat || !tags[1].Encrypted || tags[1].AuthData != "MySql Password 2" ||
+		tags[1].KeyName != "myteamkey-2014-09-19" || tags[1].Line != 3 {
+		t.Errorf("unexpected legacy tag %+v", tags[1])
+	}
+
+	if string(file[tags[1].Offset:tags[1].Offset+tags[1].Length]) !=
+		"[gosecret|MySql Password 2|LVwaZfqOLKZQMKpZ85DTYlJDBA6dl8eL7Gcw0xY=|3tfbw3Lg8JHg3dVN|myteamkey-2014-09-19]" {
+		t.Error("legacy tag offsets are wrong")
+	}
+}
+
+func TestFindTagsUnencrypted(t *testing.T) {
+	content := []byte(`a {{ goEncrypt "auth \"quoted\"" ` + "`raw|text`" + ` "key" -}} b [gosecret|x|y] {{ .Values.x }} {{goDecrypt "too few"}}`)
+
+	tags := FindTags(content)
+	if len(tags) != 2 {
+		t.Fatalf("expected 2 tags, got %d", len(tags))
+	}
+
+	if tags[0].Encrypted || tags[0].AuthData != `auth "quoted"` || string(tags[0].Plaintext) != "raw|text" || tags[0].KeyName != "key" {
+		t.Errorf("unexpected template tag %+v", tags[0])
+	}
+	if tags[1].Encrypted || tags[1].AuthData != "x" || string(tags[1].Plaintext) != "y" || tags[1].KeyName != "" {
+		t.Errorf("unexpected legacy tag %+v", tags[1])
+	}
+}
+
+func TestReplaceTagsRoundTrip(t *testing.T) {
+	content := []byte("a: [gosecret|legacy|one]\nb: {{goEncrypt \"quoted \\\"auth\\\"\" \"two\" \"myteamkey-2014-09-19\"}}\n")
+
+	encrypted, err := ReplaceTags(content, FindTags(content), func(tag Tag) ([]byte, error) {
+		keyname := tag.KeyName
+		if keyname == "" {
+			keyname = "myteamkey-2014-09-19"
+		}
+		e, err := tag.Encrypt(keyname, "../test_keys", "")
+		return []byte(e.String()), err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := FindTags(encrypted)
+	if len(tags) != 2 || !tags[0].Encrypted || !tags[1].Encrypted || tags[1].AuthData != `quoted "auth"` {
+		t.Fatalf("unexpected tags %+v in %q", tags, encrypted)
+	}
+
+	decrypted, err := ReplaceTags(encrypted, tags, func(tag Tag) ([]byte, error) {
+		return tag.Decrypt("../test_keys")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "a: one\nb: two\n" {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+}
+
+func TestFindTagsDelims(t *testing.T) {
+	content := []byte(`host: {{ .Values.host }}
+password: [[- goEncrypt "db" "hunter2" "myteamkey-2014-09-19" -]]
+other: {{goEncrypt "ignored" "x" "myteamkey-2014-09-19"}}`)
+
+	tags := FindTagsDelims(content, "[[", "]]")
+	if len(tags) != 1 || tags[0].AuthData != "db" || tags[0].Line != 2 || tags[0].LeftDelim != "[[" {
+		t.Fatalf("unexpected tags %+v", tags)
+	}
+
+	encrypted, err := tags[0].Encrypt("myteamkey-2014-09-19", "../test_keys", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := encrypted.String()
+	if s[:len("[[- goDecrypt")] != "[[- goDecrypt" || s[len(s)-4:] != " -]]" {
+		t.Errorf("expected %q to use the delimiters it was found with", s)
+	}
+}
+
+func TestFindTagsManyActions(t *testing.T) {
+	// Each action must be parsed without copying the rest of the document, or large templates take quadratic time.
+	content := strings.Repeat("{{ .Values.host }}\n", 100000) + `{{goEncrypt "db" "hunter2" "myteamkey-2014-09-19"}}`
+	tags := FindTags([]byte(content))
+	if len(tags) != 1 || tags[0].AuthData != "db" || tags[0].Line != 100001 {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
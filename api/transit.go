@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransitScheme is the scheme of key file references to data keys wrapped by a TransitBackend.
+const TransitScheme = "transit"
+
+// A TransitBackend is a KeyBackend whose master keys are held by an HTTP service with the API of Vault's
+// transit secrets engine.  Key files refer to data keys wrapped by it as
+//
+//	transit:<master key name>:<ciphertext>
+//
+// Unwrapped data keys are cached in locked memory until Close, so each is unwrapped only once.
+type TransitBackend struct {
+	address string
+	token   string
+	mount   string
+	client  *http.Client
+
+	lock  sync.Mutex
+	cache keyCache
+}
+
+// NewTransitBackend returns a TransitBackend for the service at address, such as https://vault:8200,
+// authenticating with token.  Mount is the path at which the transit engine is mounted, "transit" if empty.
+// If tlsConfig is not nil, it configures connections to the service.
+func NewTransitBackend(address, token, mount string, tlsConfig *tls.Config) *TransitBackend {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &TransitBackend{
+		address: strings.TrimRight(address, "/"),
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+		cache: make(keyCache),
+	}
+}
+
+// WrapKey encrypts a data key with the named master key, returning the reference to store in a key file.
+func (t *TransitBackend) WrapKey(masterKey string, key []byte) (string, error) {
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	request := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := t.call("encrypt", masterKey, request, &response); err != nil {
+		return "", err
+	}
+	if response.Data.Ciphertext == "" {
+		return "", fmt.Errorf("transit encrypt with key %s returned no ciphertext", masterKey)
+	}
+	return TransitScheme + ":" + masterKey + ":" + response.Data.Ciphertext, nil
+}
+
+// UnwrapKey decrypts the data key identified by ref, of the form <master key name>:<ciphertext>.
+func (t *TransitBackend) UnwrapKey(ref string) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if key, ok := t.cache.get(ref); ok {
+		return key, nil
+	}
+
+	i := strings.IndexByte(ref, ':')
+	if i <= 0 {
+		return nil, fmt.Errorf("malformed transit key reference %q", ref)
+	}
+	masterKey, ciphertext := ref[:i], ref[i+1:]
+
+	var response struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := t.call("decrypt", masterKey, map[string]string{"ciphertext": ciphertext}, &response); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(response.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("transit decrypt with key %s returned a malformed plaintext: %v", masterKey, err)
+	}
+
+	t.cache.put(ref, key)
+	return key, nil
+}
+
+// Close wipes the cached data keys.  The backend remains usable, but unwraps data keys again.
+func (t *TransitBackend) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cache.clear()
+}
+
+// Call a transit endpoint, such as encrypt or decrypt, for a master key.
+func (t *TransitBackend) call(operation, masterKey string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	endpoint := t.address + "/v1/" + t.mount + "/" + operation + "/" + url.PathEscape(masterKey)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", t.token)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("transit %s with key %s failed: %v", operation, masterKey, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(message, &failure) == nil && len(failure.Errors) > 0 {
+			message = []byte(strings.Join(failure.Errors, "; "))
+		}
+		return fmt.Errorf("transit %s with key %s failed: %s: %s", operation, masterKey, resp.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A stub of the transit encrypt and decrypt endpoints, which "encrypts" by remembering plaintexts.
+func newTransitStub(t *testing.T, token string) (*httptest.Server, *int) {
+	var plaintexts []string
+	decrypts := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/master":
+			plaintexts = append(plaintexts, request["plaintext"])
+			json.NewEncoder(w).Encode(map[string]map[string]string{
+				"data": {"ciphertext": "vault:v1:" + strconv.Itoa(len(plaintexts)-1)},
+			})
+		case "/v1/transit/decrypt/master":
+			decrypts++
+			i, err := strconv.Atoi(strings.TrimPrefix(request["ciphertext"], "vault:v1:"))
+			if err != nil || i >= len(plaintexts) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string][]string{"errors": {"invalid ciphertext"}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]map[string]string{"data": {"plaintext": plaintexts[i]}})
+		default:
+			http.NotFound(w, r)
+		}
+	})), &decrypts
+}
+
+func TestTransitBackend(t *testing.T) {
+	stub, decrypts := newTransitStub(t, "s.token")
+	defer stub.Close()
+
+	keyroot, err := ioutil.TempDir("", "gosecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyroot)
+
+	backend := NewTransitBackend(stub.URL, "s.token", "", nil)
+	ref, err := backend.WrapKey("master", CreateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "transit:master:vault:v1:0" {
+		t.Errorf("unexpected reference %q", ref)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keyroot, "wrapped"), []byte(ref+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterKeyBackend(TransitScheme, backend)
+	defer RegisterKeyBackend(TransitScheme, nil)
+
+	encrypted, err := EncryptTags([]byte("[gosecret|a|one] [gosecret|b|two]"), "wrapped", keyroot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptTags(encrypted, keyroot)
+	if err != nil || string(decrypted) != "one two" {
+		t.Errorf("unexpected decryption %q: %v", decrypted, err)
+	}
+	if *decrypts != 1 {
+		t.Errorf("expected the data key to be unwrapped once, got %d", *decrypts)
+	}
+
+	_, err = NewTransitBackend(stub.URL, "wrong", "", nil).UnwrapKey("master:vault:v1:0")
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the service's error, got %v", err)
+	}
+}
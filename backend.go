@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"filippo.io/age"
+	"flag"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+)
+
+// backendFlags are the flags that configure key backends, for key files that refer to keys held elsewhere.
+type backendFlags struct {
+	transitAddress    string
+	transitToken      string
+	transitMount      string
+	transitCA         string
+	transitSkipVerify bool
+	kmsEndpoint       string
+	kmsRegion         string
+	ageIdentities     stringList
+	pgpKeyring        string
+	pgpSecretKeyring  string
+	auditLog          string
+	auditSyslog       bool
+}
+
+// register defines the key backend flags in flags.
+func (b *backendFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&b.transitAddress, "transit-addr", "", "address of the transit key service; defaults to $VAULT_ADDR")
+	flags.StringVar(&b.transitToken, "transit-token", "", "token for the transit key service; defaults to $VAULT_TOKEN")
+	flags.StringVar(&b.transitMount, "transit-mount", "transit", "path at which the transit engine is mounted")
+	flags.StringVar(&b.transitCA, "transit-ca", "", "PEM file of CA certificates for the transit key service; defaults to $VAULT_CACERT")
+	flags.BoolVar(&b.transitSkipVerify, "transit-skip-verify", false, "do not verify the transit key service's certificate")
+	flags.StringVar(&b.kmsRegion, "kms-region", "", "AWS region of KMS keys named as kms:<key>; defaults to $AWS_REGION")
+	flags.StringVar(&b.kmsEndpoint, "kms-endpoint", "", "URL of a KMS-compatible service to use instead of AWS KMS")
+	flags.Var(&b.ageIdentities, "identity", "age identity file for tags encrypted to age recipients; may be repeated")
+	flags.StringVar(&b.pgpKeyring, "pgp-keyring", "", "OpenPGP public keyring holding the keys of -pgp-recipient recipients")
+	flags.StringVar(&b.pgpSecretKeyring, "pgp-secret-keyring", "", "OpenPGP secret keyring for tags encrypted to OpenPGP keys; the passphrase is read from $GOSECRET_PGP_PASSPHRASE")
+	flags.StringVar(&b.auditLog, "audit-log", "", "file to append a JSON line to for each tag encrypted or decrypted; defaults to $GOSECRET_AUDIT_LOG")
+	flags.BoolVar(&b.auditSyslog, "audit-syslog", false, "send a JSON line to syslog for each tag encrypted or decrypted")
+}
+
+// configure registers the key backends the flags, or the environment, configure, and the audit sink if any.
+func (b *backendFlags) configure() error {
+	if err := b.configureAudit(); err != nil {
+		return err
+	}
+
+	transit, err := b.transit()
+	if err != nil {
+		return err
+	}
+	if transit != nil {
+		gosecret.RegisterKeyBackend(gosecret.TransitScheme, transit)
+	}
+
+	// AWS credentials are taken from the environment, as by the AWS command line tools.
+	region := firstNonEmpty(b.kmsRegion, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+	if region != "" || b.kmsEndpoint != "" {
+		if region == "" {
+			region = "us-east-1"
+		}
+		gosecret.RegisterKeyBackend(gosecret.KMSScheme, gosecret.NewKMSBackend(b.kmsEndpoint, region,
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")))
+	}
+
+	var identities []age.Identity
+	for _, identityFile := range b.ageIdentities {
+		file, err := os.Open(identityFile)
+		if err != nil {
+			return err
+		}
+		parsed, err := age.ParseIdentities(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read age identities from %s: %v", identityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	gosecret.RegisterKeyBackend(gosecret.AgeScheme, gosecret.NewAgeBackend(identities...))
+
+	public, err := readKeyring(b.pgpKeyring)
+	if err != nil {
+		return err
+	}
+	secret, err := readKeyring(b.pgpSecretKeyring)
+	if err != nil {
+		return err
+	}
+	gosecret.RegisterKeyBackend(gosecret.PGPScheme,
+		gosecret.NewPGPBackend(public, secret, []byte(os.Getenv("GOSECRET_PGP_PASSPHRASE"))))
+
+	return nil
+}
+
+// configureAudit sets the audit sink the flags, or the environment, configure.
+func (b *backendFlags) configureAudit() error {
+	auditLog := firstNonEmpty(b.auditLog, os.Getenv("GOSECRET_AUDIT_LOG"))
+	if auditLog != "" && b.auditSyslog {
+		return errors.New("only one of -audit-log and -audit-syslog may be given")
+	}
+	if auditLog != "" {
+		sink, err := gosecret.OpenAuditLog(auditLog)
+		if err != nil {
+			return fmt.Errorf("unable to open audit log: %v", err)
+		}
+		gosecret.SetAuditSink(sink)
+	}
+	if b.auditSyslog {
+		sink, err := gosecret.NewSyslogAuditSink("gosecret")
+		if err != nil {
+			return fmt.Errorf("unable to connect to syslog: %v", err)
+		}
+		gosecret.SetAuditSink(sink)
+	}
+	return nil
+}
+
+// readKeyring reads the OpenPGP keyring in path, or returns an empty keyring if path is empty.
+func readKeyring(path string) (openpgp.EntityList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keyring, err := gosecret.ReadKeyring(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read OpenPGP keyring %s: %v", path, err)
+	}
+	return keyring, nil
+}
+
+// transit returns the TransitBackend the flags configure, or nil if no transit service address is known.
+func (b *backendFlags) transit() (*gosecret.TransitBackend, error) {
+	address := firstNonEmpty(b.transitAddress, os.Getenv("VAULT_ADDR"))
+	if address == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: b.transitSkipVerify}
+	if ca := firstNonEmpty(b.transitCA, os.Getenv("VAULT_CACERT")); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + ca)
+		}
+	}
+
+	token := firstNonEmpty(b.transitToken, os.Getenv("VAULT_TOKEN"))
+	return gosecret.NewTransitBackend(address, token, b.transitMount, tlsConfig), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+)
+
+// convertCommand rewrites the tags in files between the legacy and template formats, without decrypting or
+// re-encrypting anything.
+func convertCommand(args []string) int {
+	var to string
+	var keyname string
+	var delimsFlag string
+	var inPlace bool
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flags.StringVar(&to, "to", "template", "format to convert tags to, template or legacy")
+	flags.StringVar(&keyname, "key", "", "key for unencrypted legacy tags to be encrypted with once they are template tags")
+	flags.StringVar(&delimsFlag, "delims", "", "left and right template delimiters, separated by a space")
+	flags.BoolVar(&inPlace, "w", false, "rewrite the files instead of printing the converted file")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret convert [options] file ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 || (flags.NArg() > 1 && !inPlace) {
+		flags.Usage()
+		return 1
+	}
+
+	var format gosecret.TagFormat
+	switch to {
+	case "template":
+		format = gosecret.TemplateFormat
+	case "legacy":
+		format = gosecret.LegacyFormat
+	default:
+		fmt.Println("Unknown format", to)
+		return 1
+	}
+	delims, err := parseDelims(delimsFlag)
+	if err != nil {
+		fmt.Println("Invalid -delims", err)
+		return 1
+	}
+
+	for _, fileName := range flags.Args() {
+		status := rewriteFile(fileName, inPlace, func(content []byte) ([]byte, error) {
+			return gosecret.ConvertTags(content, format, keyname, delims[0], delims[1])
+		})
+		if status != 0 {
+			return status
+		}
+	}
+
+	return 0
+}
+
+// rewriteFile converts the content of a file with convert, printing the result or, if inPlace is set, rewriting
+// the file with it, and returns the command's exit status.
+func rewriteFile(fileName string, inPlace bool, convert func([]byte) ([]byte, error)) int {
+	gosecret.SetAuditSource(fileName)
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		fmt.Println("Unable to read file", err)
+		return 2
+	}
+
+	converted, err := convert(content)
+	if err != nil {
+		fmt.Println("Unable to convert", fileName, err)
+		return 3
+	}
+
+	if !inPlace {
+		fmt.Print(string(converted))
+		return 0
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		fmt.Println("Unable to read file", err)
+		return 2
+	}
+	if err := writeFileAtomic(fileName, converted, info.Mode().Perm()); err != nil {
+		fmt.Println("Unable to write file", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+// setNotDumpable does nothing on these systems, where disableCoreDumps relies on the core file size limit alone.
+func setNotDumpable() error {
+	return nil
+}
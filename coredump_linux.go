@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// PR_SET_DUMPABLE, from <linux/prctl.h>.
+const prSetDumpable = 4
+
+// setNotDumpable marks the process not dumpable, which also keeps other processes of the same user from
+// attaching to it with ptrace.
+func setNotDumpable() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
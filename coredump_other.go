@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+// disableCoreDumps stops the process from dumping core.  It is only implemented on Unix systems; elsewhere core
+// dumps are left as the system configures them.
+func disableCoreDumps() error {
+	return nil
+}
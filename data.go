@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A stringList is a flag that may be repeated, collecting every value given.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// loadTemplateData builds the data that templates are executed with: the top-level keys of a JSON or YAML
+// data file, overridden by -var key=value pairs, plus an Env map of the environment variables.
+func loadTemplateData(dataFile string, vars []string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+
+	if dataFile != "" {
+		file, err := ioutil.ReadFile(dataFile)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(filepath.Ext(dataFile)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(file, &data)
+		default:
+			err = json.Unmarshal(file, &data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", dataFile, err)
+		}
+	}
+
+	for _, v := range vars {
+		i := strings.Index(v, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("expected -var key=value, got %q", v)
+		}
+		data[v[:i]] = v[i+1:]
+	}
+
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	data["Env"] = env
+
+	return data, nil
+}
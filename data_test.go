@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTemplateData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataFile := filepath.Join(dir, "data.yaml")
+	if err := ioutil.WriteFile(dataFile, []byte("host: db1\nport: 3306\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOSECRET_TEST_VAR", "from-env")
+	defer os.Unsetenv("GOSECRET_TEST_VAR")
+
+	data, err := loadTemplateData(dataFile, []string{"host=db2", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := decryptDocument([]byte("{{.host}}:{{.port}} {{.Env.GOSECRET_TEST_VAR}} [{{.empty}}]"),
+		decryptOptions{keystore: "./test_keys", data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "db2:3306 from-env []" {
+		t.Errorf("unexpected output %q", output)
+	}
+
+	if _, err := loadTemplateData("", []string{"novalue"}); err == nil {
+		t.Error("expected -var without = to fail")
+	}
+}
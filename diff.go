@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+)
+
+// diffCommand compares two versions of a document tag by tag, without printing any plaintext.  Like diff(1),
+// it exits 0 if the documents are equivalent, 1 if they differ, and 2 on error.
+func diffCommand(args []string) int {
+	var keystore string
+	var asJSON bool
+	var all bool
+	var backends backendFlags
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.BoolVar(&asJSON, "json", false, "print the differences as JSON")
+	flags.BoolVar(&all, "all", false, "also report secrets that are unchanged")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret diff [options] old new\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 2
+	}
+
+	old, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Println("Unable to read file", err)
+		return 2
+	}
+	new, err := ioutil.ReadFile(flags.Arg(1))
+	if err != nil {
+		fmt.Println("Unable to read file", err)
+		return 2
+	}
+
+	gosecret.SetAuditSource(flags.Arg(0) + " " + flags.Arg(1))
+	diff, err := gosecret.DiffDocuments(old, new, keystore)
+	if err != nil {
+		fmt.Println("Unable to compare files", err)
+		return 2
+	}
+
+	type secret struct {
+		AuthData   string `json:"auth_data"`
+		Change     string `json:"change"`
+		OldKeyName string `json:"old_key_name,omitempty"`
+		NewKeyName string `json:"new_key_name,omitempty"`
+	}
+	type line struct {
+		Op      string `json:"op"`
+		OldLine int    `json:"old_line,omitempty"`
+		NewLine int    `json:"new_line,omitempty"`
+		Text    string `json:"text"`
+	}
+	report := struct {
+		Secrets []secret `json:"secrets"`
+		Text    []line   `json:"text"`
+	}{[]secret{}, []line{}}
+
+	for _, s := range diff.Secrets {
+		rekeyed := s.OldKeyName != "" && s.NewKeyName != "" && s.OldKeyName != s.NewKeyName
+		if s.Change != gosecret.SecretUnchanged || rekeyed || all {
+			report.Secrets = append(report.Secrets, secret{s.AuthData, s.Change.String(), s.OldKeyName, s.NewKeyName})
+		}
+	}
+	for _, l := range diff.Text {
+		report.Text = append(report.Text, line{string(l.Op), l.OldLine, l.NewLine, l.Text})
+	}
+
+	if asJSON {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Println("Unable to encode differences", err)
+			return 2
+		}
+		fmt.Println(string(encoded))
+	} else {
+		for _, s := range report.Secrets {
+			fmt.Printf("secret %q %s", s.AuthData, s.Change)
+			if s.OldKeyName != s.NewKeyName && s.OldKeyName != "" && s.NewKeyName != "" {
+				fmt.Printf(" (key %s -> %s)", s.OldKeyName, s.NewKeyName)
+			}
+			fmt.Println()
+		}
+		for _, l := range report.Text {
+			lineNumber := l.OldLine
+			if l.Op == "+" {
+				lineNumber = l.NewLine
+			}
+			fmt.Printf("%s%d: %s\n", l.Op, lineNumber, l.Text)
+		}
+	}
+
+	if diff.Changed() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"regexp"
+)
+
+// filterFlags are the flags that select which tags to decrypt.
+type filterFlags struct {
+	keys       stringList
+	auth       stringList
+	authRegexp string
+}
+
+// register defines the filter flags in flags.
+func (f *filterFlags) register(flags *flag.FlagSet) {
+	flags.Var(&f.keys, "only-key", "only decrypt tags whose key name matches this pattern; may be repeated")
+	flags.Var(&f.auth, "only-auth", "only decrypt tags whose auth data matches this pattern; may be repeated")
+	flags.StringVar(&f.authRegexp, "only-auth-regexp", "", "only decrypt tags whose auth data matches this regular expression")
+}
+
+// filter returns a TagFilter accepting the tags that match every kind of filter given, or nil if none were.
+func (f *filterFlags) filter() (gosecret.TagFilter, error) {
+	var filters []gosecret.TagFilter
+	if len(f.keys) > 0 {
+		filters = append(filters, gosecret.KeyNameFilter(f.keys...))
+	}
+	if len(f.auth) > 0 {
+		filters = append(filters, gosecret.AuthDataFilter(f.auth...))
+	}
+	if f.authRegexp != "" {
+		re, err := regexp.Compile(f.authRegexp)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, gosecret.AuthDataRegexpFilter(re))
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return gosecret.AllFilters(filters...), nil
+}
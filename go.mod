@@ -0,0 +1,14 @@
+module github.com/cimpress-mcp/gosecret
+
+go 1.22
+
+require (
+	filippo.io/age v1.2.1
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require github.com/cloudflare/circl v1.3.7 // indirect
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keysCommand implements the key management subcommands of gosecret keys.
+func keysCommand(args []string) int {
+	subcommands := map[string]func([]string) int{
+		"split":   keysSplit,
+		"combine": keysCombine,
+		"usage":   keysUsage,
+		"find":    keysFind,
+		"wrap":    keysWrap,
+	}
+
+	if len(args) > 0 {
+		if subcommand, ok := subcommands[args[0]]; ok {
+			return subcommand(args[1:])
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: gosecret keys split|combine|usage|find|wrap [options] args")
+	return 1
+}
+
+// A keystoreFlag is a -keystore flag.  Its value is a search path of keystore directories separated by
+// os.PathListSeparator, and repeating the flag adds directories to the end of the search path.
+type keystoreFlag struct {
+	path *string
+	set  bool
+}
+
+// keystoreVar defines a -keystore flag in flags, storing the search path in path.
+func keystoreVar(flags *flag.FlagSet, path *string) {
+	*path = "/keys/"
+	flags.Var(&keystoreFlag{path: path}, "keystore",
+		"directory in which keys are stored; a search path of directories separated by "+
+			string(os.PathListSeparator)+", or repeated, is searched in order")
+}
+
+func (f *keystoreFlag) String() string {
+	if f.path == nil {
+		return ""
+	}
+	return *f.path
+}
+
+func (f *keystoreFlag) Set(value string) error {
+	if f.set {
+		*f.path += string(os.PathListSeparator) + value
+	} else {
+		*f.path = value
+		f.set = true
+	}
+	return nil
+}
+
+// keysFind reports where in the keystore search path each named key is found, or every location checked for
+// a key that is missing.
+func keysFind(args []string) int {
+	var keystore string
+	flags := flag.NewFlagSet("keys find", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret keys find [options] keyname ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	status := 0
+	for _, keyname := range flags.Args() {
+		keypath, err := gosecret.FindKey(keystore, keyname)
+		if err != nil {
+			fmt.Println(err)
+			status = 2
+			continue
+		}
+		fmt.Println(keyname, keypath)
+	}
+	return status
+}
+
+// keysSplit splits a key from the keystore into shares, printing them to stdout or writing one file per share.
+func keysSplit(args []string) int {
+	var keystore string
+	var n, m int
+	var outDir string
+	var backends backendFlags
+	flags := flag.NewFlagSet("keys split", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.IntVar(&n, "n", 5, "number of shares to create")
+	flags.IntVar(&m, "m", 3, "number of shares required to recover the key")
+	flags.StringVar(&outDir, "out", "", "directory to write one file per share to instead of printing the shares")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret keys split [options] keyname\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	keyname := flags.Arg(0)
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	key, err := gosecret.ReadKey(keystore, keyname)
+	if err != nil {
+		fmt.Println("Unable to read key", keyname, err)
+		return 2
+	}
+
+	shares, err := gosecret.SplitKey(key, keyname, n, m)
+	if err != nil {
+		fmt.Println("Unable to split key", err)
+		return 4
+	}
+
+	for _, share := range shares {
+		if outDir == "" {
+			fmt.Println(share)
+			continue
+		}
+		shareFile := filepath.Join(outDir, fmt.Sprintf("%s.share-%d", keyname, share.Index))
+		if err := ioutil.WriteFile(shareFile, []byte(share.String()+"\n"), 0600); err != nil {
+			fmt.Println("Unable to write share", err)
+			return 8
+		}
+	}
+
+	return 0
+}
+
+// keysCombine reads shares from the given files, or from stdin if none are given, and writes the recovered key.
+func keysCombine(args []string) int {
+	var keystore string
+	var out string
+	flags := flag.NewFlagSet("keys combine", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.StringVar(&out, "out", "", "path of the recovered key file; defaults to the key's name in the first keystore directory")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret keys combine [options] [sharefile ...]\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	var shares []gosecret.Share
+	if flags.NArg() == 0 {
+		read, err := readShares(os.Stdin)
+		if err != nil {
+			fmt.Println("Unable to read shares", err)
+			return 2
+		}
+		shares = read
+	}
+	for _, fileName := range flags.Args() {
+		file, err := os.Open(fileName)
+		if err != nil {
+			fmt.Println("Unable to read shares", err)
+			return 2
+		}
+		read, err := readShares(file)
+		file.Close()
+		if err != nil {
+			fmt.Println("Unable to read shares from", fileName, err)
+			return 2
+		}
+		shares = append(shares, read...)
+	}
+
+	key, err := gosecret.CombineShares(shares)
+	if err != nil {
+		fmt.Println("Unable to recover key", err)
+		return 4
+	}
+
+	if out == "" {
+		dirs := gosecret.KeystoreDirs(keystore)
+		if len(dirs) == 0 {
+			fmt.Println("A -keystore or -out must be given")
+			return 1
+		}
+		// Shares are not authenticated, so the key name they record must not lead out of the keystore.
+		if err := gosecret.CheckKeyName(shares[0].KeyName); err != nil {
+			fmt.Println("Unable to recover key", err)
+			return 4
+		}
+		out = filepath.Join(dirs[0], shares[0].KeyName)
+	}
+	encodedKey := make([]byte, base64.StdEncoding.EncodedLen(len(key)))
+	base64.StdEncoding.Encode(encodedKey, key)
+	defer gosecret.Wipe(encodedKey)
+	if status := writeNewKeyFile(out, encodedKey); status != 0 {
+		return status
+	}
+
+	return 0
+}
+
+// readShares parses one share per non-blank line of r.
+func readShares(r io.Reader) ([]gosecret.Share, error) {
+	var shares []gosecret.Share
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		share, err := gosecret.ParseShare(line)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, scanner.Err()
+}
+
+// keysWrap creates a key whose data key is wrapped by a master key held by the transit key service, writing a
+// key file that refers to it.  With -from, an existing key is wrapped instead of a new one.
+func keysWrap(args []string) int {
+	var keystore string
+	var master string
+	var from string
+	var out string
+	var backends backendFlags
+	flags := flag.NewFlagSet("keys wrap", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.StringVar(&master, "master", "", "name of the transit master key to wrap the key with")
+	flags.StringVar(&from, "from", "", "name of an existing key in the keystore to wrap instead of creating a new key")
+	flags.StringVar(&out, "out", "", "path of the key file to write; defaults to the key's name in the first keystore directory")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret keys wrap [options] -master name keyname\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 || master == "" {
+		flags.Usage()
+		return 1
+	}
+	keyname := flags.Arg(0)
+
+	transit, err := backends.transit()
+	if err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+	if transit == nil {
+		fmt.Println("A transit key service address must be given with -transit-addr or $VAULT_ADDR")
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	key := gosecret.CreateKey()
+	if from != "" {
+		if key, err = gosecret.ReadKey(keystore, from); err != nil {
+			fmt.Println("Unable to read key", from, err)
+			return 2
+		}
+	}
+
+	ref, err := transit.WrapKey(master, key)
+	if err != nil {
+		fmt.Println("Unable to wrap key", err)
+		return 4
+	}
+
+	if out == "" {
+		dirs := gosecret.KeystoreDirs(keystore)
+		if len(dirs) == 0 {
+			fmt.Println("A -keystore or -out must be given")
+			return 1
+		}
+		out = filepath.Join(dirs[0], keyname)
+	}
+	return writeNewKeyFile(out, []byte(ref+"\n"))
+}
+
+// writeNewKeyFile creates the key file at path, readable only by its owner, holding contents.  An existing file
+// is never overwritten, even one created concurrently.  Returns the exit status.
+func writeNewKeyFile(path string, contents []byte) int {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		fmt.Println("Refusing to overwrite existing key file", path)
+		return 8
+	}
+	if err != nil {
+		fmt.Println("Unable to write key", err)
+		return 8
+	}
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		fmt.Println("Unable to write key", err)
+		return 8
+	}
+	return 0
+}
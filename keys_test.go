@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeysCombineSearchPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosecret-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := gosecret.CreateKey()
+	shares, err := gosecret.SplitKey(key, "recovered", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareFile := filepath.Join(dir, "shares")
+	if err := ioutil.WriteFile(shareFile, []byte(shares[0].String()+"\n"+shares[2].String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	os.Mkdir(first, 0700)
+	os.Mkdir(second, 0700)
+	if status := keysCombine([]string{"-keystore", first + string(os.PathListSeparator) + second, shareFile}); status != 0 {
+		t.Fatalf("unexpected exit status %d", status)
+	}
+	recovered, err := gosecret.ReadKey(first, "recovered")
+	if err != nil || !bytes.Equal(recovered, key) {
+		t.Errorf("expected the key to be written to the first keystore directory: %v", err)
+	}
+}
+
+func TestKeysCombineKeyName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosecret-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keystore := filepath.Join(dir, "keystore")
+	os.Mkdir(keystore, 0700)
+
+	for _, keyname := range []string{"../escaped", "sub/key", ".."} {
+		shares, err := gosecret.SplitKey(gosecret.CreateKey(), keyname, 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shareFile := filepath.Join(dir, "shares")
+		if err := ioutil.WriteFile(shareFile, []byte(shares[0].String()+"\n"+shares[1].String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if status := keysCombine([]string{"-keystore", keystore, shareFile}); status != 4 {
+			t.Errorf("expected shares of the key %q to be refused, got exit status %d", keyname, status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Error("expected no key to be written outside the keystore")
+	}
+
+	shares, err := gosecret.SplitKey(gosecret.CreateKey(), "existing", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareFile := filepath.Join(dir, "shares")
+	if err := ioutil.WriteFile(shareFile, []byte(shares[0].String()+"\n"+shares[1].String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(keystore, "existing")
+	if err := ioutil.WriteFile(existing, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := keysCombine([]string{"-keystore", keystore, shareFile}); status != 8 {
+		t.Errorf("expected an existing key file to be refused, got exit status %d", status)
+	}
+	if contents, _ := ioutil.ReadFile(existing); string(contents) != "original" {
+		t.Errorf("existing key file was overwritten with %q", contents)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+)
+
+// A tagListing describes a tag without revealing its plaintext, as reported by gosecret list.
+type tagListing struct {
+	File             string `json:"file"`
+	Offset           int    `json:"offset"`
+	Line             int    `json:"line"`
+	Column           int    `json:"column"`
+	Format           string `json:"format"`
+	Encrypted        bool   `json:"encrypted"`
+	AuthData         string `json:"auth_data"`
+	KeyName          string `json:"key_name,omitempty"`
+	InitVectorLength int    `json:"iv_length"`
+	CipherTextLength int    `json:"ciphertext_length"`
+	Context          string `json:"context,omitempty"`
+}
+
+// listCommand prints every tag in the given files without decrypting anything.
+func listCommand(args []string) int {
+	var asJSON bool
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	flags.BoolVar(&asJSON, "json", false, "print the tags as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret list [options] file ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	listings, err := listTags(flags.Args())
+	if err != nil {
+		fmt.Println("Unable to read file", err)
+		return 2
+	}
+
+	if asJSON {
+		encoded, err := json.MarshalIndent(listings, "", "  ")
+		if err != nil {
+			fmt.Println("Unable to encode tags", err)
+			return 4
+		}
+		fmt.Println(string(encoded))
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tFORMAT\tSTATE\tKEY\tIV\tCIPHERTEXT\tAUTH DATA")
+	for _, l := range listings {
+		state := "encrypted"
+		if !l.Encrypted {
+			state = "unencrypted"
+		}
+		fmt.Fprintf(w, "%s:%d:%d\t%s\t%s\t%s\t%d\t%d\t%q\n",
+			l.File, l.Line, l.Column, l.Format, state, l.KeyName, l.InitVectorLength, l.CipherTextLength, l.AuthData)
+	}
+	w.Flush()
+
+	return 0
+}
+
+// listTags returns a listing of every tag in the given files, in order.
+func listTags(fileNames []string) ([]tagListing, error) {
+	listings := []tagListing{}
+	for _, fileName := range fileNames {
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range gosecret.FindTags(content) {
+			listings = append(listings, tagListing{
+				fileName, tag.Offset, tag.Line, tag.Column, tag.Format.String(), tag.Encrypted,
+				tag.AuthData, tag.KeyName, len(tag.InitVector), len(tag.CipherText), tag.Context,
+			})
+		}
+	}
+	return listings, nil
+}
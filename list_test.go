@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestListTags(t *testing.T) {
+	file := "test_data/template/encrypted_hybrid.json"
+	listings, err := listTags([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []tagListing{
+		{file, 20, 2, 19, "template", true, "MySql Password", "myteamkey-2014-09-19", 12, 29, ""},
+		{file, 156, 3, 19, "legacy", true, "MySql Password 2", "myteamkey-2014-09-19", 12, 29, ""},
+	}
+	if len(listings) != len(expected) {
+		t.Fatalf("expected %d tags, got %v", len(expected), listings)
+	}
+	for i, l := range listings {
+		if l != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], l)
+		}
+	}
+	if _, err := listTags([]string{file, "test_data/missing.json"}); err == nil {
+		t.Error("expected a missing file to fail")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -10,36 +9,117 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"text/template"
 )
 
 func main() {
 	os.Exit(realMain())
 }
 
+// Subcommands, invoked as gosecret <command> [options] [args].  Anything else falls through to the
+// -mode flag interface.
+var commands = map[string]func([]string) int{
+	"keys":          keysCommand,
+	"inventory":     keysUsage,
+	"list":          listCommand,
+	"diff":          diffCommand,
+	"watch":         watchCommand,
+	"serve":         serveCommand,
+	"convert":       convertCommand,
+	"import-sops":   importSOPSCommand,
+	"export-sops":   exportSOPSCommand,
+	"ansible-vault": ansibleVaultCommand,
+	"manifest":      manifestCommand,
+}
+
 func realMain() int {
+	// Every command may hold keys and plaintexts in memory, so none of them should leave a core dump behind.
+	if err := disableCoreDumps(); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to disable core dumps", err)
+	}
+	defer gosecret.CloseKeyBackends()
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			return command(os.Args[2:])
+		}
+	}
+
 	var mode string
 	var value string
 	var keystore string
 	var keyname string
 	var rotate bool
 	var fileName string
+	var context string
+	var seal bool
+	var requireSeal bool
+	var sealKeys stringList
+	var dataFile string
+	var vars stringList
+	var delimsFlag string
+	var tagsOnly bool
+	var oldKeys stringList
+	var filters filterFlags
+	var verify bool
+	var showLast int
+	var backends backendFlags
+	var recipients stringList
+	var pgpRecipients stringList
 	flag.Usage = usage
 	flag.StringVar(
 		&mode, "mode", "encrypt",
-		"mode of operation, either keygen, encrypt, or decrypt; defaults to encrypt")
+		"mode of operation, one of keygen, encrypt, decrypt, or redact; defaults to encrypt")
 	flag.StringVar(
 		&value, "value", "",
 		"value to encrypt/decrypt in lieu of file")
-	flag.StringVar(
-		&keystore, "keystore", "/keys/",
-		"directory in which keys are stored")
+	keystoreVar(flag.CommandLine, &keystore)
 	flag.StringVar(
 		&keyname, "key", "",
 		"name of a key file to use for encryption")
 	flag.BoolVar(
 		&rotate, "rotate", true,
 		"if encrypting, whether to rotate any already-encrypted tags to the new key")
+	flag.StringVar(
+		&context, "context", "",
+		"logical document name to bind tags to, so that tags moved to another document or position fail to decrypt")
+	flag.BoolVar(
+		&seal, "seal", false,
+		"if encrypting, append a seal authenticating the whole document with the -key")
+	flag.BoolVar(
+		&requireSeal, "require-seal", false,
+		"if decrypting, fail unless the document has a valid seal; a seal that is present is always verified")
+	flag.Var(
+		&sealKeys, "seal-key",
+		"if decrypting, only accept a seal made with a key matching this name or pattern; may be repeated")
+	flag.StringVar(
+		&dataFile, "data", "",
+		"if decrypting, JSON or YAML file whose top-level keys are available to the template")
+	flag.Var(
+		&vars, "var",
+		"if decrypting, key=value to make available to the template as .key; may be repeated")
+	flag.StringVar(
+		&delimsFlag, "delims", "",
+		"left and right template delimiters, separated by a space, for files that are themselves templates, e.g. \"[[ ]]\"")
+	flag.BoolVar(
+		&tagsOnly, "tags-only", false,
+		"if decrypting, rewrite only gosecret tags, passing other template actions through unchanged instead of executing them; encryption always does")
+	flag.Var(
+		&oldKeys, "rotate-from",
+		"if rotating, only rotate tags encrypted with keys matching this name or pattern; may be repeated")
+	filters.register(flag.CommandLine)
+	backends.register(flag.CommandLine)
+	flag.Var(
+		&recipients, "recipient",
+		"if encrypting, encrypt to this age recipient instead of a -key; may be repeated")
+	flag.Var(
+		&pgpRecipients, "pgp-recipient",
+		"if encrypting, encrypt to this OpenPGP key ID, fingerprint or email in the -pgp-keyring instead of a -key; may be repeated")
+	flag.BoolVar(
+		&verify, "verify", false,
+		"if redacting, decrypt every tag first, failing if any cannot be, and show the length of each secret")
+	flag.IntVar(
+		&showLast, "show-last", 0,
+		"if redacting, show up to this many trailing characters of each secret; implies -verify")
 	flag.Parse()
 	if value == "" {
 		if flag.NArg() != 1 {
@@ -49,75 +129,104 @@ func realMain() int {
 			fileName = flag.Args()[0]
 		}
 	}
-	if mode == "encrypt" {
-		if (keyname == "") {
-			fmt.Println("A -key must be provided for encryption")
-			return 2
-		}
-		rawBytes := getBytes(value, fileName)
 
-		fileContents, err := gosecret.EncryptTags(rawBytes, keyname, keystore, rotate)
-		if (err != nil) {
-			fmt.Println("encryption failed", err)
-			return 4
-		}
+	data, err := loadTemplateData(dataFile, vars)
+	if err != nil {
+		fmt.Println("Unable to load template data", err)
+		return 1
+	}
+
+	delims, err := parseDelims(delimsFlag)
+	if err != nil {
+		fmt.Println("Invalid -delims", err)
+		return 1
+	}
 
-		data := string(fileContents)
+	filter, err := filters.filter()
+	if err != nil {
+		fmt.Println("Invalid filter", err)
+		return 1
+	}
 
-		// Create a template, add the function map, and parse the text.
-		// FuncMap maps the goEncrypt (and goDecrypt below) names to functions so that the
-		// template recognizes and knows what to do when it encounters such tags during parsing
-		funcs := template.FuncMap{
-			// Template functions
-			"goEncrypt": goEncryptFunc(keystore),
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	if len(recipients) > 0 {
+		if keyname != "" {
+			fmt.Println("Only one of -key and -recipient may be given")
+			return 2
 		}
+		keyname = gosecret.AgeScheme + ":" + strings.Join(recipients, ",")
+	}
+	if len(pgpRecipients) > 0 {
+		if keyname != "" {
+			fmt.Println("Only one of -key, -recipient and -pgp-recipient may be given")
+			return 2
+		}
+		keyname = gosecret.PGPScheme + ":" + strings.Join(pgpRecipients, ",")
+	}
 
-		tmpl, err := template.New("encryption").Funcs(funcs).Parse(data)
-		if err != nil {
-			fmt.Println("Could not parse template", err)
-			return 99
+	if mode == "encrypt" {
+		if (keyname == "") {
+			fmt.Println("A -key must be provided for encryption")
+			return 2
 		}
+		rawBytes := getBytes(value, fileName)
 
-		// Run the template to verify the output.
-		buff := new(bytes.Buffer)
-		err = tmpl.Execute(buff, nil)
+		output, err := encryptDocument(rawBytes, encryptOptions{
+			keystore: keystore,
+			keyname:  keyname,
+			rotate:   rotate,
+			context:  context,
+			seal:     seal,
+			delims:   delims,
+			oldKeys:  oldKeys,
+		})
 		if err != nil {
-			fmt.Println("Could not execute template", err)
-			return 98
+			e := err.(*modeError)
+			fmt.Println(e.message, e.err)
+			return e.code
 		}
 
-		fmt.Printf(string(buff.Bytes()))
+		fmt.Print(string(output))
 
 	} else if mode == "decrypt" {
 		rawBytes := getBytes(value, fileName)
-		fileContents, err := gosecret.DecryptTags(rawBytes, keystore)
-		if (err != nil) {
-			fmt.Println("err", err)
-			return 8
+
+		output, err := decryptDocument(rawBytes, decryptOptions{
+			keystore:    keystore,
+			context:     context,
+			requireSeal: requireSeal,
+			sealKeys:    sealKeys,
+			data:        data,
+			delims:      delims,
+			tagsOnly:    tagsOnly,
+			filter:      filter,
+		})
+		if err != nil {
+			e := err.(*modeError)
+			fmt.Println(e.message, e.err)
+			return e.code
 		}
 
-		data := string(fileContents)
+		fmt.Print(string(output))
 
-		funcs := template.FuncMap{
-			// Template functions
-			"goDecrypt": goDecryptFunc(keystore),
-		}
+	} else if mode == "redact" {
+		rawBytes := getBytes(value, fileName)
 
-		tmpl, err := template.New("decryption").Funcs(funcs).Parse(data)
-		if err != nil {
-			fmt.Println("Could not parse template", err)
-			return 99
+		keyroot := ""
+		if verify || showLast > 0 {
+			keyroot = keystore
 		}
-
-		// Run the template to verify the output.
-		buff := new(bytes.Buffer)
-		err = tmpl.Execute(buff, nil)
+		output, err := gosecret.RedactTags(rawBytes, keyroot, delims[0], delims[1], showLast)
 		if err != nil {
-			fmt.Println("Could not execute template", err)
-			return 98
+			fmt.Println("Could not redact", err)
+			return 8
 		}
 
-		fmt.Printf(string(buff.Bytes()))
+		fmt.Print(string(output))
 
 	} else if mode == "keygen" {
 		key := gosecret.CreateKey()
@@ -136,6 +245,7 @@ func getBytes(value string, fileName string) []byte {
 	if value != "" {
 		return []byte(value)
 	}
+	gosecret.SetAuditSource(fileName)
 	file, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		fmt.Println("Unable to read file for encryption", err)
@@ -152,6 +262,16 @@ func usage() {
 
 const helpText = `
 Usage: %s [options] file
+       %[1]s keys split|combine|usage|find|wrap [options] args
+       %[1]s inventory [options] path ...
+       %[1]s list [options] file ...
+       %[1]s diff [options] old new
+       %[1]s watch [options] -target dir source ...
+       %[1]s serve [options] (-socket path | -listen address)
+       %[1]s convert [options] file ...
+       %[1]s import-sops|export-sops [options] file ...
+       %[1]s ansible-vault import|render [options] file ...
+       %[1]s manifest [options] -name name [key=]path ...
 
   Encrypt or decrypt file using gosecret.
 
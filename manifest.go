@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kubernetes allows only these characters in the keys of Secret and ConfigMap data.
+var manifestKeyRegex = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// A manifest is a Kubernetes Secret or ConfigMap.
+type manifest struct {
+	APIVersion string            `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string            `json:"kind" yaml:"kind"`
+	Metadata   manifestMetadata  `json:"metadata" yaml:"metadata"`
+	Type       string            `json:"type,omitempty" yaml:"type,omitempty"`
+	Data       map[string]string `json:"data,omitempty" yaml:"data,omitempty"`
+	BinaryData map[string]string `json:"binaryData,omitempty" yaml:"binaryData,omitempty"`
+}
+
+type manifestMetadata struct {
+	Name      string            `json:"name" yaml:"name"`
+	Namespace string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// A manifestFile is a file to put in a manifest, under the data key key.
+type manifestFile struct {
+	key  string
+	path string
+}
+
+// manifestOptions are the settings of gosecret manifest.  If configMap is set, files without tags go in a
+// ConfigMap named configMapName instead of the Secret, rendered with the same template data.
+type manifestOptions struct {
+	decrypt       decryptOptions
+	name          string
+	namespace     string
+	labels        map[string]string
+	secretType    string
+	configMap     bool
+	configMapName string
+}
+
+// manifestCommand decrypts files and prints a Kubernetes Secret manifest holding them, so that decrypted
+// secrets can be applied to a cluster without passing through hand-written scripts.
+func manifestCommand(args []string) int {
+	var opts manifestOptions
+	var labels stringList
+	var format string
+	var dataFile string
+	var vars stringList
+	var delims string
+	var backends backendFlags
+	flags := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	keystoreVar(flags, &opts.decrypt.keystore)
+	flags.StringVar(&opts.name, "name", "", "name of the Secret")
+	flags.StringVar(&opts.namespace, "namespace", "", "namespace of the Secret")
+	flags.Var(&labels, "label", "key=value label to give the Secret; may be repeated")
+	flags.StringVar(&opts.secretType, "type", "Opaque", "type of the Secret")
+	flags.BoolVar(&opts.configMap, "configmap", false, "put files without gosecret tags in a ConfigMap instead of the Secret")
+	flags.StringVar(&opts.configMapName, "configmap-name", "", "name of the ConfigMap; defaults to the -name of the Secret")
+	flags.StringVar(&format, "format", "yaml", "manifest format, yaml or json")
+	flags.BoolVar(&opts.decrypt.requireSeal, "require-seal", false, "only decrypt documents with a valid seal")
+	flags.Var((*stringList)(&opts.decrypt.sealKeys), "seal-key", "only accept a seal made with a key matching this name or pattern; may be repeated")
+	flags.StringVar(&dataFile, "data", "", "JSON or YAML file whose top-level keys are available to templates")
+	flags.Var(&vars, "var", "key=value to make available to templates as .key; may be repeated")
+	flags.BoolVar(&opts.decrypt.tagsOnly, "tags-only", false, "rewrite only gosecret tags, passing other template actions through")
+	flags.StringVar(&delims, "delims", "", "left and right template delimiters, separated by a space")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret manifest [options] -name name [key=]path ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if opts.name == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+	if format != "yaml" && format != "json" {
+		fmt.Println("Unknown format", format)
+		return 1
+	}
+
+	opts.labels = make(map[string]string)
+	for _, label := range labels {
+		i := strings.IndexByte(label, '=')
+		if i < 1 {
+			fmt.Println("Invalid -label", label, "expected key=value")
+			return 1
+		}
+		opts.labels[label[:i]] = label[i+1:]
+	}
+	if opts.configMapName == "" {
+		opts.configMapName = opts.name
+	}
+
+	data, err := loadTemplateData(dataFile, vars)
+	if err != nil {
+		fmt.Println("Unable to load template data", err)
+		return 1
+	}
+	opts.decrypt.data = data
+	if opts.decrypt.delims, err = parseDelims(delims); err != nil {
+		fmt.Println("Invalid -delims", err)
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	files, err := manifestFiles(flags.Args())
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	manifests, err := buildManifests(files, opts)
+	if err != nil {
+		if e, ok := err.(*modeError); ok {
+			fmt.Println(e.message, e.err)
+			return e.code
+		}
+		fmt.Println(err)
+		return 2
+	}
+	output, err := marshalManifests(manifests, format)
+	if err != nil {
+		fmt.Println("Unable to write manifest", err)
+		return 3
+	}
+	fmt.Print(string(output))
+	return 0
+}
+
+// manifestFiles expands command line arguments, each a path optionally preceded by key=, into the files they
+// name.  A directory stands for the regular files directly in it other than dot files, each under its name.
+func manifestFiles(args []string) ([]manifestFile, error) {
+	var files []manifestFile
+	seen := make(map[string]string)
+	add := func(key, path string) error {
+		if !manifestKeyRegex.MatchString(key) {
+			return fmt.Errorf("%s is not a valid key for %s; use key=path", key, path)
+		}
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("%s and %s both have the key %s", other, path, key)
+		}
+		seen[key] = path
+		files = append(files, manifestFile{key, path})
+		return nil
+	}
+
+	for _, arg := range args {
+		key, path := "", arg
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			key, path = arg[:i], arg[i+1:]
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if key == "" {
+				key = filepath.Base(path)
+			}
+			if err := add(key, path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if key != "" {
+			return nil, errors.New("a key cannot be given for the directory " + path)
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				if err := add(entry.Name(), filepath.Join(path, entry.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// buildManifests decrypts files and returns the Secret, and if requested the ConfigMap, holding them.  Only
+// manifests with data are returned, except that the Secret always is.
+func buildManifests(files []manifestFile, opts manifestOptions) ([]manifest, error) {
+	metadata := manifestMetadata{Name: opts.name, Namespace: opts.namespace, Labels: opts.labels}
+	if len(metadata.Labels) == 0 {
+		metadata.Labels = nil
+	}
+	secret := manifest{APIVersion: "v1", Kind: "Secret", Metadata: metadata, Type: opts.secretType,
+		Data: make(map[string]string)}
+	metadata.Name = opts.configMapName
+	configMap := manifest{APIVersion: "v1", Kind: "ConfigMap", Metadata: metadata}
+
+	for _, file := range files {
+		gosecret.SetAuditSource(file.path)
+		content, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Binary files cannot hold tags or template actions, so they are copied as they are.
+		text, tagged := utf8.Valid(content), false
+		if text {
+			tagged = mayHoldSecrets(content, opts.decrypt.delims)
+			if content, err = decryptDocument(content, opts.decrypt); err != nil {
+				if e, ok := err.(*modeError); ok {
+					e.message = file.path + ": " + e.message
+					return nil, e
+				}
+				return nil, fmt.Errorf("%s: %v", file.path, err)
+			}
+		}
+
+		if !opts.configMap || tagged {
+			secret.Data[file.key] = base64.StdEncoding.EncodeToString(content)
+		} else if text {
+			if configMap.Data == nil {
+				configMap.Data = make(map[string]string)
+			}
+			configMap.Data[file.key] = string(content)
+		} else {
+			if configMap.BinaryData == nil {
+				configMap.BinaryData = make(map[string]string)
+			}
+			configMap.BinaryData[file.key] = base64.StdEncoding.EncodeToString(content)
+		}
+	}
+
+	manifests := []manifest{secret}
+	if configMap.Data != nil || configMap.BinaryData != nil {
+		manifests = append(manifests, configMap)
+	}
+	return manifests, nil
+}
+
+// Report whether content may hold secrets once decrypted.  Besides tags that FindTags finds, template actions
+// can call goDecrypt with arguments other than literal strings, and malformed legacy tags are decrypted if they
+// can be, so any mention of either is enough.
+func mayHoldSecrets(content []byte, delims [2]string) bool {
+	return len(gosecret.FindTagsDelims(content, delims[0], delims[1])) > 0 ||
+		bytes.Contains(content, []byte("goDecrypt")) || bytes.Contains(content, []byte("[gosecret|"))
+}
+
+// marshalManifests writes manifests as YAML documents separated by ---, or as JSON, wrapping several manifests
+// in a List.
+func marshalManifests(manifests []manifest, format string) ([]byte, error) {
+	if format == "json" {
+		var value interface{} = manifests[0]
+		if len(manifests) > 1 {
+			value = map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": manifests}
+		}
+		output, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(output, '\n'), nil
+	}
+
+	var documents []string
+	for _, m := range manifests {
+		output, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, string(output))
+	}
+	return []byte(strings.Join(documents, "---\n")), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	encrypted, err := encryptDocument([]byte("password: [gosecret|db|hunter2]\n"),
+		encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"db.yaml":  encrypted,
+		"app.conf": []byte("debug = {{.debug}}\n"),
+		".hidden":  []byte("ignored"),
+		"logo.bin": {0xff, 0xfe},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := manifestFiles([]string{dir, "creds=" + filepath.Join(dir, "db.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("expected the directory's three files and one named file, got %v", files)
+	}
+	if _, err := manifestFiles([]string{dir, dir}); err == nil {
+		t.Error("expected duplicate keys to be refused")
+	}
+
+	opts := manifestOptions{
+		decrypt:       decryptOptions{keystore: "./test_keys", data: map[string]interface{}{"debug": true}},
+		name:          "app",
+		namespace:     "prod",
+		labels:        map[string]string{"team": "payments"},
+		secretType:    "Opaque",
+		configMap:     true,
+		configMapName: "app-config",
+	}
+	manifests, err := buildManifests(files, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 2 {
+		t.Fatalf("expected a Secret and a ConfigMap, got %v", manifests)
+	}
+	secret, configMap := manifests[0], manifests[1]
+	plaintext := base64.StdEncoding.EncodeToString([]byte("password: hunter2\n"))
+	if secret.Kind != "Secret" || secret.Data["db.yaml"] != plaintext || secret.Data["creds"] != plaintext || len(secret.Data) != 2 {
+		t.Errorf("unexpected Secret %v", secret)
+	}
+	if configMap.Kind != "ConfigMap" || configMap.Metadata.Name != "app-config" || configMap.Data["app.conf"] != "debug = true\n" ||
+		configMap.BinaryData["logo.bin"] != "//4=" {
+		t.Errorf("unexpected ConfigMap %v", configMap)
+	}
+
+	output, err := marshalManifests(manifests, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(output), "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\n  namespace: prod\n  labels:\n    team: payments\ntype: Opaque\ndata:\n") ||
+		!strings.Contains(string(output), "---\napiVersion: v1\nkind: ConfigMap\n") {
+		t.Errorf("unexpected YAML manifests %s", output)
+	}
+	output, err = marshalManifests(manifests, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), `"kind": "List"`) || !strings.Contains(string(output), `"db.yaml": "`+plaintext+`"`) {
+		t.Errorf("unexpected JSON manifests %s", output)
+	}
+
+	broken := filepath.Join(dir, "broken.conf")
+	if err := ioutil.WriteFile(broken, []byte("debug = {{.debug\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildManifests([]manifestFile{{"broken.conf", broken}}, opts); err == nil || !strings.HasPrefix(err.Error(), broken+": ") {
+		t.Errorf("expected a ConfigMap file that is not a valid template to be refused, got %v", err)
+	}
+
+	// goDecrypt with arguments that are not literal strings decrypts a tag that FindTags cannot see.
+	computed := filepath.Join(dir, "computed.json")
+	if err := ioutil.WriteFile(computed, []byte(`{{goDecrypt (print "MySql Password") "PA9aGEFVYzHpXxJseVc4mjC45B0zGb3Qlr4m9b8=" "+N8VCOKvAJbGTrLH" "myteamkey-2014-09-19"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifests, err = buildManifests([]manifestFile{{"computed.json", computed}}, opts)
+	if err != nil || len(manifests) != 1 || manifests[0].Data["computed.json"] != base64.StdEncoding.EncodeToString([]byte("kadjf454nkklz")) {
+		t.Errorf("expected a file calling goDecrypt to go in the Secret, got %v: %v", manifests, err)
+	}
+
+	opts.configMap = false
+	if manifests, err = buildManifests(files, opts); err != nil || len(manifests) != 1 || len(manifests[0].Data) != 4 {
+		t.Errorf("expected every file in the Secret, got %v: %v", manifests, err)
+	}
+}
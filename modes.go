@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"strings"
+	"text/template"
+)
+
+// A modeError is a failure of encryption or decryption, carrying the message to print and the exit code
+// gosecret has always used for it.
+type modeError struct {
+	message string
+	code    int
+	err     error
+}
+
+func (e *modeError) Error() string {
+	return fmt.Sprint(e.message, " ", e.err)
+}
+
+// encryptOptions are the settings that control encrypt mode.  If oldKeys is not empty, rotation is limited
+// to tags encrypted with a key matching one of its patterns.
+type encryptOptions struct {
+	keystore string
+	keyname  string
+	rotate   bool
+	context  string
+	seal     bool
+	delims   [2]string
+	oldKeys  []string
+}
+
+// decryptOptions are the settings that control decrypt mode.  If filter is not nil, only the tags it accepts
+// are decrypted.  If sealKeys is not empty, a seal must name a key matching one of its patterns.
+type decryptOptions struct {
+	keystore    string
+	context     string
+	requireSeal bool
+	sealKeys    []string
+	data        map[string]interface{}
+	delims      [2]string
+	tagsOnly    bool
+	filter      gosecret.TagFilter
+}
+
+// encryptDocument encrypts every legacy and template tag in content, as encrypt mode does.  The document is not
+// rendered as a template: all other text, including other template actions, is copied unchanged.
+func encryptDocument(content []byte, opts encryptOptions) ([]byte, error) {
+	// Any existing seal is invalidated by encryption and is replaced below if requested.
+	content, _ = gosecret.RemoveSeal(content)
+
+	var binding gosecret.Binding
+	if opts.context != "" {
+		if err := gosecret.CheckDocumentName(opts.context); err != nil {
+			return nil, &modeError{"encryption failed", 4, err}
+		}
+		binding = gosecret.DocumentBinding(opts.context)
+	}
+
+	var err error
+	if opts.rotate {
+		// Re-encrypt tags of both formats that are already encrypted before encrypting new ones.
+		content, err = gosecret.RotateTags(content, opts.keyname, opts.keystore, opts.delims[0], opts.delims[1], binding, opts.oldKeys)
+		if err != nil {
+			return nil, &modeError{"rotation failed", 4, err}
+		}
+	}
+
+	var fileContents []byte
+	if opts.context != "" {
+		fileContents, err = gosecret.EncryptTagsBound(content, opts.keyname, opts.keystore, false, binding)
+	} else {
+		fileContents, err = gosecret.EncryptTags(content, opts.keyname, opts.keystore, false)
+	}
+	if err != nil {
+		return nil, &modeError{"encryption failed", 4, err}
+	}
+
+	// Rewrite just the goEncrypt tags, leaving any other template syntax alone, so that actions such as {{.host}}
+	// are kept for decryption to render, and bound tags are numbered by their position in the document.
+	output, err := gosecret.EncryptTemplateTags(fileContents, opts.keystore, opts.delims[0], opts.delims[1], binding)
+	if err != nil {
+		return nil, &modeError{"encryption failed", 4, err}
+	}
+	return sealIfRequested(output, opts)
+}
+
+// Append a seal to an encrypted document if encryptOptions ask for one.
+func sealIfRequested(content []byte, opts encryptOptions) ([]byte, error) {
+	if opts.seal {
+		sealed, err := gosecret.SealDocument(content, opts.keyname, opts.keystore)
+		if err != nil {
+			return nil, &modeError{"Could not seal document", 4, err}
+		}
+		return sealed, nil
+	}
+
+	return content, nil
+}
+
+// decryptDocument decrypts every legacy and template tag in content, as decrypt mode does.
+func decryptDocument(content []byte, opts decryptOptions) ([]byte, error) {
+	// Verify the seal before decrypting anything, so that no plaintext is emitted from a modified document.
+	content, err := gosecret.VerifySealKeys(content, opts.keystore, opts.requireSeal, opts.sealKeys)
+	if err != nil {
+		return nil, &modeError{"Could not verify seal", 8, err}
+	}
+
+	var binding gosecret.Binding
+	if opts.context != "" {
+		if err := gosecret.CheckDocumentName(opts.context); err != nil {
+			return nil, &modeError{"err", 8, err}
+		}
+		binding = gosecret.DocumentBinding(opts.context)
+	}
+
+	var fileContents []byte
+	if opts.filter != nil {
+		fileContents, err = gosecret.DecryptTagsFiltered(content, opts.keystore, binding, opts.filter)
+	} else if opts.context != "" {
+		fileContents, err = gosecret.DecryptTagsBound(content, opts.keystore, binding)
+	} else {
+		fileContents, err = gosecret.DecryptTags(content, opts.keystore)
+	}
+	if err != nil {
+		return nil, &modeError{"err", 8, err}
+	}
+
+	if opts.tagsOnly {
+		output, err := gosecret.DecryptTemplateTagsFiltered(fileContents, opts.keystore, opts.delims[0], opts.delims[1], binding, opts.filter)
+		if err != nil {
+			return nil, &modeError{"err", 8, err}
+		}
+		return output, nil
+	}
+
+	data := string(fileContents)
+
+	decrypt, keep := goDecryptFunc(opts.keystore), goKeepFunc(opts.delims[0], opts.delims[1])
+	if opts.context != "" {
+		decrypt, keep = goDecryptBoundFunc(opts.keystore, fileContents, binding, opts.delims[0], opts.delims[1])
+	}
+	if opts.filter != nil {
+		decrypt = goDecryptFilteredFunc(decrypt, keep, opts.filter)
+	}
+	funcs := template.FuncMap{
+		// Template functions
+		"goDecrypt": decrypt,
+	}
+
+	tmpl, err := template.New("decryption").Delims(opts.delims[0], opts.delims[1]).Funcs(funcs).Parse(data)
+	if err != nil {
+		return nil, &modeError{"Could not parse template", 99, err}
+	}
+
+	// Run the template to verify the output.
+	buff := new(bytes.Buffer)
+	err = tmpl.Execute(buff, opts.data)
+	if err != nil {
+		return nil, &modeError{"Could not execute template", 98, err}
+	}
+
+	return buff.Bytes(), nil
+}
+
+// parseDelims parses the value of a -delims flag, the left and right template delimiters separated by white
+// space.  An empty value means the default delimiters.
+func parseDelims(value string) ([2]string, error) {
+	var delims [2]string
+	if value == "" {
+		return delims, nil
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return delims, fmt.Errorf("expected left and right delimiters separated by a space, got %q", value)
+	}
+	copy(delims[:], fields)
+	return delims, nil
+}
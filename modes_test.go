@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"strings"
+	"testing"
+)
+
+func TestDocumentDelims(t *testing.T) {
+	content := []byte("host: {{ .Values.host }}\npassword: [[goEncrypt \"db\" \"hunter2\" \"myteamkey-2014-09-19\"]]\n")
+	delims, err := parseDelims("[[ ]]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := encryptDocument(content, encryptOptions{keystore: "./test_keys", delims: delims})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encrypted), "[[goDecrypt \"db\"") || strings.Contains(string(encrypted), "hunter2") {
+		t.Fatalf("unexpected encryption %q", encrypted)
+	}
+
+	decrypted, err := decryptDocument(encrypted, decryptOptions{keystore: "./test_keys", delims: delims})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "host: {{ .Values.host }}\npassword: hunter2\n" {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+
+	if _, err := parseDelims("[["); err == nil {
+		t.Error("expected a single delimiter to be rejected")
+	}
+}
+
+func TestDocumentTagsOnly(t *testing.T) {
+	content := []byte("{{ .Values.host }} {{ end }}: [gosecret|legacy|one] {{goEncrypt \"db\" \"two\" \"myteamkey-2014-09-19\"}}\n")
+
+	// Encryption never renders the document, so unrelated actions pass through even if they do not parse.
+	encrypted, err := encryptDocument(content, encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(encrypted), "{{ .Values.host }} {{ end }}: [gosecret|legacy|") {
+		t.Errorf("unexpected encryption %q", encrypted)
+	}
+
+	if _, err := decryptDocument(encrypted, decryptOptions{keystore: "./test_keys"}); err == nil {
+		t.Fatal("expected rendering a document with unrelated actions as a template to fail")
+	}
+	decrypted, err := decryptDocument(encrypted, decryptOptions{keystore: "./test_keys", tagsOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "{{ .Values.host }} {{ end }}: one two\n" {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+}
+
+func TestDocumentEncryptKeepsActions(t *testing.T) {
+	// Encrypt once, render per environment: template actions are left for decryption to fill in.
+	content := []byte("host: {{.host}}\npassword: {{goEncrypt \"db\" \"hunter2\" \"myteamkey-2014-09-19\"}}\n")
+	encrypted, err := encryptDocument(content, encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(encrypted), "host: {{.host}}\npassword: {{goDecrypt \"db\" ") {
+		t.Fatalf("unexpected encryption %q", encrypted)
+	}
+
+	for host, expected := range map[string]string{"db1": "host: db1\npassword: hunter2\n", "db2": "host: db2\npassword: hunter2\n"} {
+		decrypted, err := decryptDocument(encrypted, decryptOptions{keystore: "./test_keys", data: map[string]interface{}{"host": host}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != expected {
+			t.Errorf("expected %q, got %q", expected, decrypted)
+		}
+	}
+}
+
+func TestDocumentRotatesTemplateTags(t *testing.T) {
+	content := []byte("{{goEncrypt \"db\" \"one\" \"myteamkey-2014-09-19\"}} {{goEncrypt \"api\" \"two\" \"myteamkey-2014-09-19\"}}\n")
+	opts := encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19", context: "app.conf"}
+
+	encrypted, err := encryptDocument(content, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.rotate = true
+	rotated, err := encryptDocument(encrypted, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rotated, encrypted) {
+		t.Error("expected template tags to be re-encrypted")
+	}
+
+	opts.rotate = false
+	kept, err := encryptDocument(rotated, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept, rotated) {
+		t.Errorf("expected encrypted tags to pass through, got %q from %q", kept, rotated)
+	}
+
+	decrypted, err := decryptDocument(kept, decryptOptions{keystore: "./test_keys", context: "app.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "one two\n" {
+		t.Errorf("unexpected decryption %q", decrypted)
+	}
+}
+
+func TestDocumentFilter(t *testing.T) {
+	content := []byte("{{goEncrypt \"db\" \"one\" \"myteamkey-2014-09-19\"}} {{goEncrypt \"api\" \"two\" \"myteamkey-2014-09-19\"}}\n")
+	encrypted, err := encryptDocument(content, encryptOptions{keystore: "./test_keys", context: "app.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tagsOnly := range []bool{false, true} {
+		opts := decryptOptions{keystore: "./test_keys", context: "app.conf", tagsOnly: tagsOnly, filter: gosecret.AuthDataFilter("api")}
+		decrypted, err := decryptDocument(encrypted, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := gosecret.FindTags(decrypted)
+		if len(tags) != 1 || tags[0].AuthData != "db" || !strings.HasSuffix(string(decrypted), "}} two\n") {
+			t.Errorf("expected only the api tag to be decrypted, got %q", decrypted)
+		}
+	}
+}
+
+func TestDocumentBindingPositions(t *testing.T) {
+	// Conditionals change the order in which tags execute, but not their positions in the document.
+	content := []byte("{{if .first}}{{goEncrypt \"db\" \"one\" \"myteamkey-2014-09-19\"}}{{end}} {{goEncrypt \"api\" \"two\" \"myteamkey-2014-09-19\"}}\n")
+	opts := encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19", context: "app.conf"}
+	encrypted, err := encryptDocument(content, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.rotate = true
+	rotated, err := encryptDocument(encrypted, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tagsOnly := range []bool{false, true} {
+		decrypted, err := decryptDocument(rotated, decryptOptions{keystore: "./test_keys", context: "app.conf", tagsOnly: tagsOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(decrypted), " two\n") {
+			t.Errorf("unexpected decryption %q", decrypted)
+		}
+	}
+
+	if _, err := encryptDocument(content, encryptOptions{keystore: "./test_keys", context: "a|b"}); err == nil {
+		t.Error("expected a context containing | to be rejected")
+	}
+}
+
+func TestDocumentEncryptKeepsTrimmedTags(t *testing.T) {
+	content := []byte("a:\n  {{- goEncrypt \"db\" \"one\" \"myteamkey-2014-09-19\" -}}\n  b\n")
+	encrypted, err := encryptDocument(content, encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rotate := range []bool{false, true} {
+		opts := encryptOptions{keystore: "./test_keys", keyname: "myteamkey-2014-09-19", rotate: rotate}
+		reencrypted, err := encryptDocument(encrypted, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rotate && !bytes.Equal(reencrypted, encrypted) {
+			t.Errorf("expected existing tags to be copied unchanged, got %q from %q", reencrypted, encrypted)
+		}
+		if !strings.HasPrefix(string(reencrypted), "a:\n  {{- goDecrypt ") || !strings.HasSuffix(string(reencrypted), " -}}\n  b\n") {
+			t.Errorf("expected trim markers and white space to be kept, got %q", reencrypted)
+		}
+		decrypted, err := decryptDocument(reencrypted, decryptOptions{keystore: "./test_keys"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != "a:oneb\n" {
+			t.Errorf("unexpected decryption %q", decrypted)
+		}
+	}
+}
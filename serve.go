@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+)
+
+// A serveClient is an entry in the access control list of gosecret serve.  A client is identified either by
+// a bearer token, configured as the hex SHA-256 of the token so that the list holds no secrets, or, on a
+// unix socket, by the UID of the connecting process.  Keys lists the patterns, in path.Match syntax, of
+// the key names the client may use.
+type serveClient struct {
+	Name        string   `json:"name"`
+	TokenSHA256 string   `json:"token_sha256"`
+	UID         *int     `json:"uid"`
+	Keys        []string `json:"keys"`
+	Encrypt     bool     `json:"encrypt"`
+}
+
+// Report whether the client may use the key named keyname.
+func (c *serveClient) allows(keyname string) bool {
+	for _, pattern := range c.Keys {
+		if ok, _ := path.Match(pattern, keyname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// A server answers decryption and encryption requests using the keys in its keystore.
+type server struct {
+	keystore     string
+	clients      []serveClient
+	allowEncrypt bool
+	maxBody      int64
+	slots        chan struct{}
+	sealKeys     []string
+}
+
+// A serveRequest is the JSON body of a request to /v1/decrypt or /v1/encrypt.
+type serveRequest struct {
+	Content     string `json:"content"`
+	Key         string `json:"key"`
+	Context     string `json:"context"`
+	RequireSeal bool   `json:"require_seal"`
+}
+
+// A serveResponse is the JSON body of every response.
+type serveResponse struct {
+	Content string `json:"content,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// The context key under which the network connection of a request is stored.
+type connContextKey struct{}
+
+// serveCommand implements gosecret serve, a daemon that decrypts, and optionally encrypts, documents on behalf
+// of local clients over a unix socket or localhost HTTP, so that keys only need to be available to one process.
+func serveCommand(args []string) int {
+	var srv server
+	var socket, listen, aclFile string
+	var maxConcurrent int
+	var backends backendFlags
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	keystoreVar(flags, &srv.keystore)
+	flags.StringVar(&socket, "socket", "", "path of a unix socket to listen on")
+	flags.StringVar(&listen, "listen", "", "localhost address to listen on for HTTP, such as 127.0.0.1:8200")
+	flags.StringVar(&aclFile, "acl", "", "JSON file listing the clients allowed to use the service and their keys")
+	flags.BoolVar(&srv.allowEncrypt, "allow-encrypt", false, "enable the encryption endpoint")
+	flags.Int64Var(&srv.maxBody, "max-body", 1<<20, "maximum size in bytes of a request body")
+	flags.IntVar(&maxConcurrent, "max-concurrent", 16, "maximum number of requests processed at once")
+	flags.Var((*stringList)(&srv.sealKeys), "seal-key", "only accept a seal made with a key matching this name or pattern; may be repeated")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret serve [options] (-socket path | -listen address)\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if (socket == "") == (listen == "") || flags.NArg() != 0 {
+		flags.Usage()
+		return 1
+	}
+	srv.slots = make(chan struct{}, maxConcurrent)
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	if aclFile != "" {
+		clients, err := readACL(aclFile)
+		if err != nil {
+			fmt.Println("Unable to read access control list", err)
+			return 2
+		}
+		srv.clients = clients
+	} else if socket != "" {
+		// Without an access control list, only processes running as the same user may connect.
+		uid := os.Getuid()
+		srv.clients = []serveClient{{Name: "owner", UID: &uid, Keys: []string{"*"}, Encrypt: true}}
+	} else {
+		fmt.Println("An -acl is required when listening on HTTP")
+		return 2
+	}
+
+	var listener net.Listener
+	var err error
+	if socket != "" {
+		os.Remove(socket)
+		listener, err = net.Listen("unix", socket)
+		if err == nil {
+			// Every request is authorized by peer UID or token, so any local user may connect.
+			err = os.Chmod(socket, 0666)
+		}
+	} else {
+		if err = checkLoopback(listen); err == nil {
+			listener, err = net.Listen("tcp", listen)
+		}
+	}
+	if err != nil {
+		fmt.Println("Unable to listen", err)
+		return 4
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/decrypt", srv.handle(srv.decrypt))
+	mux.HandleFunc("/v1/encrypt", srv.handle(srv.encrypt))
+	mux.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, serveResponse{Content: "ok"})
+	})
+
+	httpServer := &http.Server{
+		Handler:        mux,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		MaxHeaderBytes: 16 << 10,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+		close(done)
+	}()
+
+	log.Println("Listening on", listener.Addr())
+	if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+		fmt.Println("Server failed", err)
+		return 8
+	}
+	<-done
+	if socket != "" {
+		os.Remove(socket)
+	}
+
+	return 0
+}
+
+// Read an access control list of the form {"clients": [...]}.
+func readACL(fileName string) ([]serveClient, error) {
+	file, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var acl struct {
+		Clients []serveClient `json:"clients"`
+	}
+	if err := json.Unmarshal(file, &acl); err != nil {
+		return nil, err
+	}
+	for _, c := range acl.Clients {
+		if c.TokenSHA256 == "" && c.UID == nil {
+			return nil, fmt.Errorf("client %q has neither a token_sha256 nor a uid", c.Name)
+		}
+	}
+	return acl.Clients, nil
+}
+
+// Check that an address to listen on is on a loopback interface.
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("refusing to listen on non-loopback address %s", address)
+}
+
+// Identify the client making a request, by bearer token if one is given or else by peer UID.
+func (s *server) identify(r *http.Request) *serveClient {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && auth[:7] == "Bearer " {
+		sum := sha256.Sum256([]byte(auth[7:]))
+		for i, c := range s.clients {
+			expected, err := hex.DecodeString(c.TokenSHA256)
+			if err == nil && c.TokenSHA256 != "" && hmac.Equal(sum[:], expected) {
+				return &s.clients[i]
+			}
+		}
+		return nil
+	}
+
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	if uid, _, ok := peerCred(conn); ok {
+		for i, c := range s.clients {
+			if c.UID != nil && *c.UID == uid {
+				return &s.clients[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Describe the process a request came from for the audit log: its UID and PID on a unix socket where peer
+// credentials are available, or else its address.
+func requestPeer(r *http.Request) string {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	if uid, pid, ok := peerCred(conn); ok {
+		return fmt.Sprintf("uid=%d pid=%d", uid, pid)
+	}
+	return r.RemoteAddr
+}
+
+// Wrap an endpoint with request limits, authentication, and JSON decoding and encoding.  Each endpoint is given
+// the origin to record in the audit log for the tags of its request: the request's document context as the
+// source, and the client and the process it connected from.
+func (s *server) handle(endpoint func(*serveClient, gosecret.AuditOrigin, serveRequest) (string, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeResponse(w, http.StatusMethodNotAllowed, serveResponse{Error: "only POST is supported"})
+			return
+		}
+
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			writeResponse(w, http.StatusServiceUnavailable, serveResponse{Error: "too many concurrent requests"})
+			return
+		}
+
+		client := s.identify(r)
+		if client == nil {
+			writeResponse(w, http.StatusUnauthorized, serveResponse{Error: "unknown client"})
+			return
+		}
+
+		var req serveRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxBody)).Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, serveResponse{Error: "invalid request: " + err.Error()})
+			return
+		}
+
+		origin := gosecret.AuditOrigin{Source: req.Context, Client: client.Name, Peer: requestPeer(r)}
+		content, status, err := endpoint(client, origin, req)
+		if err != nil {
+			log.Printf("%s %s for client %s failed: %v", r.Method, r.URL.Path, client.Name, err)
+			writeResponse(w, status, serveResponse{Error: err.Error()})
+			return
+		}
+		log.Printf("%s %s for client %s succeeded", r.Method, r.URL.Path, client.Name)
+		writeResponse(w, http.StatusOK, serveResponse{Content: content})
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, response serveResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Decrypt every encrypted tag in a document.  Only tags are replaced; unlike decrypt mode, other template
+// actions in the document are neither evaluated nor rejected.
+func (s *server) decrypt(client *serveClient, origin gosecret.AuditOrigin, req serveRequest) (string, int, error) {
+	content, err := gosecret.VerifySealKeys([]byte(req.Content), s.keystore, req.RequireSeal, s.sealKeys)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	if err := gosecret.CheckDocumentName(req.Context); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	tags := gosecret.FindTags(content)
+	for _, tag := range tags {
+		if tag.Encrypted && !client.allows(tag.KeyName) {
+			return "", http.StatusForbidden, fmt.Errorf("client %s may not use key %s", client.Name, tag.KeyName)
+		}
+	}
+
+	// ReplaceTagsTrimmed copies each plaintext into the output as soon as it is returned, applying the tag's trim
+	// markers as decrypt mode does.
+	contexts := tagContexts(content, tags, req.Context)
+	var opened []*gosecret.SecureBuffer
+	defer func() {
+		for _, plaintext := range opened {
+			plaintext.Destroy()
+		}
+	}()
+	output, err := gosecret.ReplaceTagsTrimmed(content, tags, func(tag gosecret.Tag) ([]byte, bool, error) {
+		if !tag.Encrypted {
+			return nil, false, nil
+		}
+		if expected := contexts[tag.Offset]; tag.Context != expected {
+			return nil, false, fmt.Errorf("tag %q is bound to context %q but context %q is required", tag.AuthData, tag.Context, expected)
+		}
+		plaintext, err := tag.DecryptSecureFrom(s.keystore, origin)
+		if err != nil {
+			return nil, false, err
+		}
+		opened = append(opened, plaintext)
+		return plaintext.Bytes(), true, nil
+	})
+	if err != nil {
+		return "", http.StatusUnprocessableEntity, err
+	}
+
+	return string(output), 0, nil
+}
+
+// Encrypt every unencrypted tag in a document.  Template tags are encrypted with the key they name and legacy
+// tags with the key given in the request.
+func (s *server) encrypt(client *serveClient, origin gosecret.AuditOrigin, req serveRequest) (string, int, error) {
+	if !s.allowEncrypt || !client.Encrypt {
+		return "", http.StatusForbidden, errors.New("encryption is not permitted")
+	}
+
+	if err := gosecret.CheckDocumentName(req.Context); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	content := []byte(req.Content)
+	tags := gosecret.FindTags(content)
+	contexts := tagContexts(content, tags, req.Context)
+	output, err := gosecret.ReplaceTags(content, tags, func(tag gosecret.Tag) ([]byte, error) {
+		if tag.Encrypted {
+			return content[tag.Offset : tag.Offset+tag.Length], nil
+		}
+		keyname := tag.KeyName
+		if tag.Format == gosecret.LegacyFormat {
+			keyname = req.Key
+		}
+		if keyname == "" {
+			return nil, fmt.Errorf("a key is required to encrypt tag %q", tag.AuthData)
+		}
+		if !client.allows(keyname) {
+			return nil, fmt.Errorf("client %s may not use key %s", client.Name, keyname)
+		}
+		encrypted, err := tag.EncryptFrom(keyname, s.keystore, contexts[tag.Offset], origin)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(encrypted.String()), nil
+	})
+	if err != nil {
+		return "", http.StatusUnprocessableEntity, err
+	}
+
+	return string(output), 0, nil
+}
+
+// Compute the context each of the tags in content, keyed by offset, is bound to for a document context,
+// numbering tags as gosecret.TagIndexes does.  No tag is bound if the document context is empty.
+func tagContexts(content []byte, tags []gosecret.Tag, document string) map[int]string {
+	contexts := make(map[int]string)
+	if document == "" {
+		return contexts
+	}
+	binding := gosecret.DocumentBinding(document)
+	for offset, index := range gosecret.TagIndexes(content, tags) {
+		contexts[offset] = binding(index)
+	}
+	return contexts
+}
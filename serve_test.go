@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestServer(clients ...serveClient) *httptest.Server {
+	srv := &server{path.Clean("./test_keys"), clients, true, 1 << 20, make(chan struct{}, 4), nil}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/decrypt", srv.handle(srv.decrypt))
+	mux.HandleFunc("/v1/encrypt", srv.handle(srv.encrypt))
+	return httptest.NewServer(mux)
+}
+
+func tokenClient(name, token string, encrypt bool, keys ...string) serveClient {
+	sum := sha256.Sum256([]byte(token))
+	return serveClient{Name: name, TokenSHA256: hex.EncodeToString(sum[:]), Keys: keys, Encrypt: encrypt}
+}
+
+func post(t *testing.T, url, token string, req serveRequest) (int, serveResponse) {
+	body, _ := json.Marshal(req)
+	httpReq, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response serveResponse
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp.StatusCode, response
+}
+
+func TestServeDecrypt(t *testing.T) {
+	ts := newTestServer(
+		tokenClient("app", "app-token", false, "myteamkey-*"),
+		tokenClient("other", "other-token", false, "otherkey"),
+	)
+	defer ts.Close()
+
+	file, err := ioutil.ReadFile(path.Join("test_data/template", "encrypted_hybrid.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(path.Join("test_data/template", "output_hybrid.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response := post(t, ts.URL+"/v1/decrypt", "app-token", serveRequest{Content: string(file)})
+	if status != http.StatusOK || response.Content != string(expected) {
+		t.Errorf("unexpected response %d %+v", status, response)
+	}
+
+	if status, _ := post(t, ts.URL+"/v1/decrypt", "other-token", serveRequest{Content: string(file)}); status != http.StatusForbidden {
+		t.Errorf("expected client without access to the key to be forbidden, got %d", status)
+	}
+
+	if status, _ := post(t, ts.URL+"/v1/decrypt", "wrong-token", serveRequest{Content: string(file)}); status != http.StatusUnauthorized {
+		t.Errorf("expected unknown client to be unauthorized, got %d", status)
+	}
+}
+
+func TestServeEncrypt(t *testing.T) {
+	ts := newTestServer(
+		tokenClient("writer", "writer-token", true, "myteamkey-*"),
+		tokenClient("reader", "reader-token", false, "myteamkey-*"),
+	)
+	defer ts.Close()
+
+	req := serveRequest{
+		Content: "{{goEncrypt \"db\" \"hunter2\" \"myteamkey-2014-09-19\"}} [gosecret|api|abc123]",
+		Key:     "myteamkey-2014-09-19",
+		Context: "app.conf",
+	}
+
+	if status, _ := post(t, ts.URL+"/v1/encrypt", "reader-token", req); status != http.StatusForbidden {
+		t.Errorf("expected client without encrypt permission to be forbidden, got %d", status)
+	}
+
+	status, encrypted := post(t, ts.URL+"/v1/encrypt", "writer-token", req)
+	if status != http.StatusOK || bytes.Contains([]byte(encrypted.Content), []byte("hunter2")) {
+		t.Fatalf("unexpected response %d %+v", status, encrypted)
+	}
+
+	status, decrypted := post(t, ts.URL+"/v1/decrypt", "reader-token", serveRequest{Content: encrypted.Content, Context: "app.conf"})
+	if status != http.StatusOK || decrypted.Content != "hunter2 abc123" {
+		t.Errorf("unexpected response %d %+v", status, decrypted)
+	}
+
+	if status, _ := post(t, ts.URL+"/v1/decrypt", "reader-token", serveRequest{Content: encrypted.Content}); status == http.StatusOK {
+		t.Error("expected bound tags to require their context")
+	}
+}
+
+func TestServeAudit(t *testing.T) {
+	var buf bytes.Buffer
+	gosecret.SetAuditSink(gosecret.NewAuditLog(&buf))
+	defer gosecret.SetAuditSink(nil)
+
+	ts := newTestServer(tokenClient("app", "app-token", true, "myteamkey-*"))
+	defer ts.Close()
+
+	req := serveRequest{Content: "[gosecret|db|hunter2]", Key: "myteamkey-2014-09-19", Context: "config.json"}
+	status, response := post(t, ts.URL+"/v1/encrypt", "app-token", req)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected response %d %+v", status, response)
+	}
+	req.Content = response.Content
+	if status, response := post(t, ts.URL+"/v1/decrypt", "app-token", req); status != http.StatusOK || response.Content != "hunter2" {
+		t.Fatalf("unexpected response %d %+v", status, response)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %s", buf.Bytes())
+	}
+	for _, line := range lines {
+		var event gosecret.AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Source != "config.json" || event.Client != "app" || !strings.HasPrefix(event.Peer, "127.0.0.1:") {
+			t.Errorf("expected the request's origin, got event %s", line)
+		}
+	}
+}
+
+func TestServeDecryptTrim(t *testing.T) {
+	ts := newTestServer(tokenClient("app", "app-token", true, "myteamkey-*"))
+	defer ts.Close()
+
+	req := serveRequest{Content: "password: \n  {{- goEncrypt \"db\" \"hunter2\" \"myteamkey-2014-09-19\" -}}  \n!"}
+	status, encrypted := post(t, ts.URL+"/v1/encrypt", "app-token", req)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected response %d %+v", status, encrypted)
+	}
+
+	expected, err := gosecret.DecryptTemplateTags([]byte(encrypted.Content), "./test_keys", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, decrypted := post(t, ts.URL+"/v1/decrypt", "app-token", serveRequest{Content: encrypted.Content})
+	if status != http.StatusOK || decrypted.Content != "password:hunter2!" || decrypted.Content != string(expected) {
+		t.Errorf("expected trim markers to be applied as decrypt mode does, got %d %+v", status, decrypted)
+	}
+}
+
+func TestServeLegacyIndexes(t *testing.T) {
+	ts := newTestServer(tokenClient("app", "app-token", false, "myteamkey-*"))
+	defer ts.Close()
+
+	// Legacy tags are numbered after the malformed block, as decrypt mode numbers them.
+	content := []byte("[gosecret|a|b|c] [gosecret|db password|hunter2]")
+	encrypted, err := gosecret.EncryptTagsBound(content, "myteamkey-2014-09-19", "./test_keys", false, gosecret.DocumentBinding("db.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, decrypted := post(t, ts.URL+"/v1/decrypt", "app-token", serveRequest{Content: string(encrypted), Context: "db.yml"})
+	if status != http.StatusOK || decrypted.Content != "[gosecret|a|b|c] hunter2" {
+		t.Errorf("unexpected response %d %+v", status, decrypted)
+	}
+}
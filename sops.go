@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"os"
+	"path/filepath"
+)
+
+// importSOPSCommand converts SOPS encrypted documents into gosecret documents, decrypting them with age or
+// OpenPGP keys available locally.
+func importSOPSCommand(args []string) int {
+	var keystore string
+	var keyname string
+	var format string
+	var inPlace bool
+	var backends backendFlags
+	flags := flag.NewFlagSet("import-sops", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.StringVar(&keyname, "key", "", "key to encrypt the imported values with")
+	flags.StringVar(&format, "format", "", "document format, json or yaml; defaults to the file's extension")
+	flags.BoolVar(&inPlace, "w", false, "rewrite the files instead of printing the imported file")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret import-sops [options] file ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 || (flags.NArg() > 1 && !inPlace) {
+		flags.Usage()
+		return 1
+	}
+	if keyname == "" {
+		fmt.Println("A -key must be provided to encrypt the imported values")
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	for _, fileName := range flags.Args() {
+		format, err := sopsFormat(format, fileName)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		status := rewriteFile(fileName, inPlace, func(content []byte) ([]byte, error) {
+			return gosecret.ImportSOPS(content, format, keyname, keystore)
+		})
+		if status != 0 {
+			return status
+		}
+	}
+	return 0
+}
+
+// exportSOPSCommand converts gosecret documents into SOPS encrypted documents, for teams that use SOPS.
+func exportSOPSCommand(args []string) int {
+	var keystore string
+	var ageRecipients stringList
+	var pgpRecipients stringList
+	var format string
+	var inPlace bool
+	var backends backendFlags
+	flags := flag.NewFlagSet("export-sops", flag.ContinueOnError)
+	keystoreVar(flags, &keystore)
+	flags.Var(&ageRecipients, "recipient", "age recipient to encrypt the SOPS document to; may be repeated")
+	flags.Var(&pgpRecipients, "pgp-recipient", "OpenPGP key ID, fingerprint or email in the -pgp-keyring to encrypt the SOPS document to; may be repeated")
+	flags.StringVar(&format, "format", "", "document format, json or yaml; defaults to the file's extension")
+	flags.BoolVar(&inPlace, "w", false, "rewrite the files instead of printing the exported file")
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret export-sops [options] file ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 || (flags.NArg() > 1 && !inPlace) {
+		flags.Usage()
+		return 1
+	}
+	if len(ageRecipients) == 0 && len(pgpRecipients) == 0 {
+		fmt.Println("A -recipient or -pgp-recipient must be provided")
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+
+	recipients := gosecret.SOPSRecipients{Age: ageRecipients}
+	if len(pgpRecipients) > 0 {
+		keyring, err := readKeyring(backends.pgpKeyring)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, name := range pgpRecipients {
+			entity, err := gosecret.FindPGPKey(keyring, name)
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			recipients.PGP = append(recipients.PGP, entity)
+		}
+	}
+
+	for _, fileName := range flags.Args() {
+		format, err := sopsFormat(format, fileName)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		status := rewriteFile(fileName, inPlace, func(content []byte) ([]byte, error) {
+			return gosecret.ExportSOPS(content, format, keystore, recipients)
+		})
+		if status != 0 {
+			return status
+		}
+	}
+	return 0
+}
+
+// sopsFormat returns the format of a SOPS document: the -format flag's value if given, or else the one its
+// extension indicates.
+func sopsFormat(format, fileName string) (string, error) {
+	if format != "" {
+		if format != gosecret.SOPSJSON && format != gosecret.SOPSYAML {
+			return "", errors.New("Unknown format " + format)
+		}
+		return format, nil
+	}
+	switch filepath.Ext(fileName) {
+	case ".json":
+		return gosecret.SOPSJSON, nil
+	case ".yaml", ".yml":
+		return gosecret.SOPSYAML, nil
+	}
+	return "", errors.New("Unable to tell the format of " + fileName + " from its extension; use -format")
+}
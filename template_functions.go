@@ -4,9 +4,18 @@ import (
 	"encoding/base64"
 	"fmt"
 	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"strconv"
+	"strings"
 )
 
 func goEncryptFunc(keystore string) func(...string) (string, error) {
+	return goEncryptDelimsFunc(keystore, "", "")
+}
+
+// goEncryptDelimsFunc behaves like goEncryptFunc, but emits goDecrypt tags with the given template delimiters,
+// or the default {{ }} if they are empty.
+func goEncryptDelimsFunc(keystore, left, right string) func(...string) (string, error) {
+	left, right = templateDelims(left, right)
 	return func(s ...string) (string, error) {
 		dt, err := gosecret.ParseEncrytionTag(keystore, s...)
 		if err != nil {
@@ -14,22 +23,119 @@ func goEncryptFunc(keystore string) func(...string) (string, error) {
 			return "", err
 		}
 
-		return (fmt.Sprintf("{{goDecrypt \"%s\" \"%s\" \"%s\" \"%s\"}}",
-			dt.AuthData,
-			base64.StdEncoding.EncodeToString(dt.CipherText),
-			base64.StdEncoding.EncodeToString(dt.InitVector),
-			dt.KeyName)), nil
+		// Tag.String quotes the arguments, so auth data containing quotes or backslashes still parses.
+		tag := gosecret.Tag{
+			Format:     gosecret.TemplateFormat,
+			Encrypted:  true,
+			AuthData:   string(dt.AuthData),
+			CipherText: dt.CipherText,
+			InitVector: dt.InitVector,
+			KeyName:    dt.KeyName,
+			LeftDelim:  left,
+			RightDelim: right,
+		}
+		return tag.String(), nil
 	}
 }
 
 func goDecryptFunc(keystore string) func(...string) (string, error) {
 	return func(s ...string) (string, error) {
-		plaintext, err := gosecret.ParseDecryptionTag(keystore, s...)
+		plaintext, err := gosecret.ParseDecryptionTagSecure(keystore, s...)
 		if err != nil {
 			fmt.Println("Unable to parse encryption tag", err)
 			return "", err
 		}
+		defer plaintext.Destroy()
+
+		// text/template needs a string, which is the only copy made outside locked memory.
+		return string(plaintext.Bytes()), nil
+	}
+}
+
+// goKeepFunc returns a goDecrypt function that emits each goDecrypt tag again, with the given template
+// delimiters, so that tags pass through decryption still encrypted.  The tag is emitted without trim markers,
+// since executing the template has already removed the white space they trim.  Encryption does not execute
+// templates, and copies tags it does not rewrite byte-for-byte.
+func goKeepFunc(left, right string) func(...string) (string, error) {
+	left, right = templateDelims(left, right)
+	return func(s ...string) (string, error) {
+		if len(s) != 4 && len(s) != 5 {
+			return "", fmt.Errorf("expected 4 or 5 arguments, got %d", len(s))
+		}
+		args := make([]string, len(s))
+		for i := range s {
+			args[i] = strconv.Quote(s[i])
+		}
+		return left + "goDecrypt " + strings.Join(args, " ") + right, nil
+	}
+}
+
+// goDecryptBoundFunc behaves like goDecryptFunc, but requires each tag to be bound to the context binding
+// returns for the tag's position among the template tags of content.  Positions are counted in document order,
+// as gosecret.DecryptTemplateTags counts them, not in the order in which the template executes tags, which
+// conditionals and loops change.  Tags that do not appear literally in content have no position and are
+// rejected.  It also returns a goKeepFunc with the given delimiters.
+func goDecryptBoundFunc(keystore string, content []byte, binding gosecret.Binding, left, right string) (func(...string) (string, error), func(...string) (string, error)) {
+	// Each tag is identified by its ciphertext and initialization vector, and mapped to the contexts of the
+	// positions at which it appears.
+	contexts := make(map[string][]string)
+	index := 0
+	for _, tag := range gosecret.FindTagsDelims(content, left, right) {
+		if tag.Format != gosecret.TemplateFormat {
+			continue
+		}
+		if tag.Encrypted {
+			id := base64.StdEncoding.EncodeToString(tag.CipherText) + "|" + base64.StdEncoding.EncodeToString(tag.InitVector)
+			contexts[id] = append(contexts[id], binding(index))
+		}
+		index++
+	}
+
+	decrypt := func(s ...string) (string, error) {
+		if len(s) != 4 && len(s) != 5 {
+			return "", fmt.Errorf("expected 4 or 5 arguments, got %d", len(s))
+		}
+		expected, ok := contexts[s[1]+"|"+s[2]]
+		if !ok {
+			return "", fmt.Errorf("tag %q does not appear in the document, so its position is unknown", s[0])
+		}
+		for _, context := range expected[1:] {
+			if context != expected[0] {
+				return "", fmt.Errorf("tag %q appears at more than one position in the document", s[0])
+			}
+		}
+
+		plaintext, err := gosecret.ParseBoundDecryptionTagSecure(keystore, expected[0], s...)
+		if err != nil {
+			fmt.Println("Unable to parse decryption tag", err)
+			return "", err
+		}
+		defer plaintext.Destroy()
+
+		return string(plaintext.Bytes()), nil
+	}
 
-		return fmt.Sprintf("%s", plaintext), nil
+	return decrypt, goKeepFunc(left, right)
+}
+
+// goDecryptFilteredFunc returns a goDecrypt function that decrypts the tags filter accepts with decrypt and
+// passes the rest through with keep.
+func goDecryptFilteredFunc(decrypt, keep func(...string) (string, error), filter gosecret.TagFilter) func(...string) (string, error) {
+	return func(s ...string) (string, error) {
+		if len(s) >= 4 && !filter(gosecret.Tag{Format: gosecret.TemplateFormat, Encrypted: true, AuthData: s[0], KeyName: s[3]}) {
+			return keep(s...)
+		}
+		return decrypt(s...)
+	}
+}
+
+// Return the template delimiters to use, substituting the defaults for empty ones as text/template does.
+func templateDelims(left, right string) (string, string) {
+	if left == "" {
+		left = gosecret.DefaultLeftDelim
+	}
+	if right == "" {
+		right = gosecret.DefaultRightDelim
 	}
+	return left, right
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/base64"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
 	"path"
 	"reflect"
 	"regexp"
@@ -39,3 +41,52 @@ func TestGoDecryptFunc(t *testing.T) {
 		t.Errorf("expected %q to be %q", result, expected)
 	}
 }
+
+func TestGoEncryptFuncQuoting(t *testing.T) {
+	f := goEncryptFunc(path.Clean("./test_keys"))
+	result, err := f(`say "hi" \ bye`, "kadjf454nkklz", "myteamkey-2014-09-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := gosecret.FindTags([]byte(result))
+	if len(tags) != 1 || tags[0].AuthData != `say "hi" \ bye` {
+		t.Errorf("expected %q to parse as a tag", result)
+	}
+}
+
+func TestGoDecryptBoundFunc(t *testing.T) {
+	keystore := path.Clean("./test_keys")
+	binding := gosecret.DocumentBinding("config.json")
+
+	content := []byte(`{{if .first}}{{goEncrypt "First" "one" "myteamkey-2014-09-19"}}{{end}}{{goEncrypt "Second" "two" "myteamkey-2014-09-19"}}`)
+	encrypted, err := gosecret.EncryptTemplateTags(content, keystore, "", "", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := gosecret.FindTags(encrypted)
+	if len(tags) != 2 || tags[1].Context != "config.json#1" {
+		t.Fatalf("expected %q to contain a tag bound to config.json#1", encrypted)
+	}
+	args := []string{
+		tags[1].AuthData,
+		base64.StdEncoding.EncodeToString(tags[1].CipherText),
+		base64.StdEncoding.EncodeToString(tags[1].InitVector),
+		tags[1].KeyName,
+		tags[1].Context,
+	}
+
+	// The second tag is the first one executed, but is still at position 1.
+	decrypt, _ := goDecryptBoundFunc(keystore, encrypted, binding, "", "")
+	plaintext, err := decrypt(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "two" {
+		t.Errorf("expected %q to be %q", plaintext, "two")
+	}
+
+	decrypt, _ = goDecryptBoundFunc(keystore, []byte("{{goDecrypt \"x\" \"eA==\" \"eA==\" \"k\" \"config.json#0\"}}"), binding, "", "")
+	if _, err := decrypt(args...); err == nil {
+		t.Error("expected a tag that is not in the document to fail")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+)
+
+// A keyReference is a single tag that references a key, as reported by gosecret keys usage.
+type keyReference struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	Format    string `json:"format"`
+	Encrypted bool   `json:"encrypted"`
+	AuthData  string `json:"auth_data"`
+}
+
+// keysUsage scans files and directory trees for tags and reports, per key name, every tag referencing it.
+func keysUsage(args []string) int {
+	var asJSON bool
+	var keyname string
+	flags := flag.NewFlagSet("keys usage", flag.ContinueOnError)
+	flags.BoolVar(&asJSON, "json", false, "print the inventory as JSON")
+	flags.StringVar(&keyname, "key", "", "only report tags referencing this key")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret keys usage [options] path ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	usage, err := scanKeyUsage(flags.Args(), keyname)
+	if err != nil {
+		fmt.Println("Unable to scan", err)
+		return 2
+	}
+
+	if asJSON {
+		encoded, err := json.MarshalIndent(usage, "", "  ")
+		if err != nil {
+			fmt.Println("Unable to encode inventory", err)
+			return 4
+		}
+		fmt.Println(string(encoded))
+		return 0
+	}
+
+	var keynames []string
+	for name := range usage {
+		keynames = append(keynames, name)
+	}
+	sort.Strings(keynames)
+
+	for _, name := range keynames {
+		fmt.Printf("%s (%d tags)\n", name, len(usage[name]))
+		for _, ref := range usage[name] {
+			state := "encrypted"
+			if !ref.Encrypted {
+				state = "unencrypted"
+			}
+			fmt.Printf("  %s:%d:%d\t%s %s\t%q\n", ref.File, ref.Line, ref.Column, state, ref.Format, ref.AuthData)
+		}
+	}
+
+	return 0
+}
+
+// scanKeyUsage walks the files and directory trees roots and returns, per key name, every tag referencing it, or
+// only the tags referencing keyname if it is not empty.  Binary files and .git directories are skipped.
+func scanKeyUsage(roots []string, keyname string) (map[string][]keyReference, error) {
+	usage := make(map[string][]keyReference)
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == ".git" && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if !utf8.Valid(content) {
+				// Binary files cannot contain tags.
+				return nil
+			}
+
+			for _, tag := range gosecret.FindTags(content) {
+				if tag.KeyName == "" || (keyname != "" && tag.KeyName != keyname) {
+					continue
+				}
+				usage[tag.KeyName] = append(usage[tag.KeyName], keyReference{
+					path, tag.Line, tag.Column, tag.Format.String(), tag.Encrypted, tag.AuthData,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", root, err)
+		}
+	}
+	return usage, nil
+}
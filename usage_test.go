@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanKeyUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosecret-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app.conf":       "[gosecret|db|aGVsbG8=|aGVsbG8=|prod-key]\n{{goEncrypt \"api\" \"s3cret\" \"dev-key\"}}\n",
+		"sub/other.conf": "\n  {{goDecrypt \"token\" \"aGVsbG8=\" \"aGVsbG8=\" \"prod-key\"}}\n",
+		".git/config":    "[gosecret|ignored|aGVsbG8=|aGVsbG8=|prod-key]\n",
+		"binary.bin":     "\xff\xfe[gosecret|ignored|aGVsbG8=|aGVsbG8=|prod-key]",
+		"plain.txt":      "[gosecret|unencrypted|value]\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := scanKeyUsage([]string{dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || len(usage["prod-key"]) != 2 || len(usage["dev-key"]) != 1 {
+		t.Fatalf("unexpected usage %v", usage)
+	}
+	expected := keyReference{filepath.Join(dir, "sub/other.conf"), 2, 3, "template", true, "token"}
+	if usage["prod-key"][1] != expected {
+		t.Errorf("expected %v, got %v", expected, usage["prod-key"][1])
+	}
+	if ref := usage["dev-key"][0]; ref.Encrypted || ref.AuthData != "api" || ref.Line != 2 {
+		t.Errorf("unexpected reference %v", ref)
+	}
+
+	usage, err = scanKeyUsage([]string{filepath.Join(dir, "app.conf")}, "dev-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || len(usage["dev-key"]) != 1 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+
+	if _, err := scanKeyUsage([]string{filepath.Join(dir, "missing")}, ""); err == nil {
+		t.Error("expected a missing path to fail")
+	}
+}
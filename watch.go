@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A watcher keeps decrypted copies of source files up to date in a target directory.
+type watcher struct {
+	sources []string
+	target  string
+	opts    decryptOptions
+	fs      *fsnotify.Watcher
+}
+
+// watchCommand implements gosecret watch, a long-running process that decrypts source files and directories
+// into a target directory and re-decrypts them whenever they, or the keys in the keystore, change.
+func watchCommand(args []string) int {
+	var opts decryptOptions
+	var target string
+	var reload string
+	var debounce time.Duration
+	var dataFile string
+	var vars stringList
+	var delims string
+	var filters filterFlags
+	var backends backendFlags
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	keystoreVar(flags, &opts.keystore)
+	flags.BoolVar(&opts.requireSeal, "require-seal", false, "only decrypt documents with a valid seal")
+	flags.Var((*stringList)(&opts.sealKeys), "seal-key", "only accept a seal made with a key matching this name or pattern; may be repeated")
+	flags.StringVar(&target, "target", "", "directory to write decrypted files to")
+	flags.StringVar(&reload, "exec", "", "command to run through the shell after decrypted files change")
+	flags.DurationVar(&debounce, "debounce", 500*time.Millisecond, "time to wait for a burst of changes to finish")
+	flags.StringVar(&dataFile, "data", "", "JSON or YAML file whose top-level keys are available to templates")
+	flags.Var(&vars, "var", "key=value to make available to templates as .key; may be repeated")
+	flags.BoolVar(&opts.tagsOnly, "tags-only", false, "rewrite only gosecret tags, passing other template actions through")
+	flags.StringVar(&delims, "delims", "", "left and right template delimiters, separated by a space")
+	filters.register(flags)
+	backends.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosecret watch [options] -target dir source ...\n\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if target == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	data, err := loadTemplateData(dataFile, vars)
+	if err != nil {
+		fmt.Println("Unable to load template data", err)
+		return 1
+	}
+	opts.data = data
+	if opts.delims, err = parseDelims(delims); err != nil {
+		fmt.Println("Invalid -delims", err)
+		return 1
+	}
+	if opts.filter, err = filters.filter(); err != nil {
+		fmt.Println("Invalid filter", err)
+		return 1
+	}
+	if err := backends.configure(); err != nil {
+		fmt.Println("Unable to configure key backend", err)
+		return 1
+	}
+	if err := checkTarget(target, flags.Args()); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Println("Unable to watch files", err)
+		return 2
+	}
+	defer fs.Close()
+
+	w := &watcher{flags.Args(), target, opts, fs}
+	for i, source := range w.sources {
+		w.sources[i] = filepath.Clean(source)
+		if err := w.watchTree(w.sources[i]); err != nil {
+			fmt.Println("Unable to watch", source, err)
+			return 2
+		}
+	}
+	for _, dir := range gosecret.KeystoreDirs(opts.keystore) {
+		if err := fs.Add(dir); err != nil {
+			fmt.Println("Unable to watch keystore", err)
+			return 2
+		}
+	}
+
+	if w.renderAll() {
+		w.runReload(reload)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return w.run(debounce, reload, signals)
+}
+
+// Process file system events until stop receives a signal, decrypting changed source files, or every source
+// file when the keystore changes, once a burst of events has lasted debounce, and then running the reload
+// command if any decrypted file changed.
+func (w *watcher) run(debounce time.Duration, reload string, stop <-chan os.Signal) int {
+	pending := make(map[string]bool)
+	keysChanged := false
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return 0
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if w.isKeystorePath(event.Name) {
+				keysChanged = true
+			} else if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				// A new directory inside a watched tree; watch it and pick up any files already in it.
+				if err := w.watchTree(event.Name); err != nil {
+					log.Println("Unable to watch", event.Name, err)
+				}
+				for _, file := range w.sourceFiles(event.Name) {
+					pending[file] = true
+				}
+			} else if _, ok := w.outputPath(event.Name); ok {
+				pending[event.Name] = true
+			}
+			flush = time.After(debounce)
+
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return 0
+			}
+			log.Println("Watch error", err)
+
+		case <-flush:
+			flush = nil
+			changed := false
+			if keysChanged {
+				log.Println("Keystore changed; decrypting all files")
+				changed = w.renderAll()
+			} else {
+				for file := range pending {
+					if w.render(file) {
+						changed = true
+					}
+				}
+			}
+			pending = make(map[string]bool)
+			keysChanged = false
+			if changed {
+				w.runReload(reload)
+			}
+
+		case sig := <-stop:
+			log.Printf("Received %v, shutting down", sig)
+			return 0
+		}
+	}
+}
+
+// checkTarget returns an error if the target directory is, or is inside, a source directory or the directory of
+// a source file.  Files written there would be seen as changes to the sources, decrypted again, and so on.
+func checkTarget(target string, sources []string) error {
+	resolved := resolvePath(target)
+	for _, source := range sources {
+		dir := resolvePath(source)
+		if info, err := os.Stat(source); err == nil && !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		rel, err := filepath.Rel(dir, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("target %s must not be inside the watched directory %s", target, dir)
+		}
+	}
+	return nil
+}
+
+// Return the absolute path of path, with symbolic links resolved in as much of it as exists.
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	if parent := filepath.Dir(path); parent != path {
+		return filepath.Join(resolvePath(parent), filepath.Base(path))
+	}
+	return path
+}
+
+// Watch a source and, if it is a directory, every directory beneath it.  A source file is watched through its
+// parent directory, so that files replaced by renaming over them are still seen.
+func (w *watcher) watchTree(root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return w.fs.Add(filepath.Dir(root))
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.fs.Add(path)
+		}
+		return nil
+	})
+}
+
+// Report whether path is in any keystore directory.
+func (w *watcher) isKeystorePath(path string) bool {
+	for _, dir := range gosecret.KeystoreDirs(w.opts.keystore) {
+		if filepath.Dir(path) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the path of the decrypted copy of a source file, or false if the file is not part of any source.
+// Hidden files, such as editor swap files, are not part of any source.
+func (w *watcher) outputPath(file string) (string, bool) {
+	file = filepath.Clean(file)
+	if strings.HasPrefix(filepath.Base(file), ".") {
+		return "", false
+	}
+	for _, source := range w.sources {
+		if file == source {
+			return filepath.Join(w.target, filepath.Base(file)), true
+		}
+		if rel, err := filepath.Rel(source, file); err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+			if info, err := os.Stat(source); err == nil && info.IsDir() {
+				return filepath.Join(w.target, rel), true
+			}
+		}
+	}
+	return "", false
+}
+
+// List the source files beneath root.
+func (w *watcher) sourceFiles(root string) []string {
+	var files []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			if _, ok := w.outputPath(path); ok {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	return files
+}
+
+// Decrypt every source file, reporting whether any decrypted file changed.
+func (w *watcher) renderAll() bool {
+	changed := false
+	for _, source := range w.sources {
+		for _, file := range w.sourceFiles(source) {
+			if w.render(file) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// Decrypt a source file into the target directory, or remove its decrypted copy if the source file no longer
+// exists.  Errors are logged, leaving any previous decrypted copy in place.  Reports whether the decrypted
+// copy changed.
+func (w *watcher) render(file string) bool {
+	output, ok := w.outputPath(file)
+	if !ok {
+		return false
+	}
+
+	gosecret.SetAuditSource(file)
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		if err := os.Remove(output); err == nil {
+			log.Println("Removed", output)
+			return true
+		}
+		return false
+	}
+	if err != nil {
+		log.Println("Unable to read", file, err)
+		return false
+	}
+
+	decrypted, err := decryptDocument(content, w.opts)
+	if err != nil {
+		log.Println("Unable to decrypt", file, err)
+		return false
+	}
+
+	if existing, err := ioutil.ReadFile(output); err == nil && bytes.Equal(existing, decrypted) {
+		return false
+	}
+
+	if err := writeFileAtomic(output, decrypted, 0600); err != nil {
+		log.Println("Unable to write", output, err)
+		return false
+	}
+	log.Println("Decrypted", file, "to", output)
+	return true
+}
+
+// Run the reload command, if any, through the shell.
+func (w *watcher) runReload(command string) {
+	if command == "" {
+		return
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Println("Reload command failed", err)
+	}
+}
+
+// Write data to a temporary file in the same directory as path and rename it into place, so that readers
+// never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
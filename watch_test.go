@@ -0,0 +1,157 @@
+package main
+
+import (
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Create a temporary directory holding a source tree and an empty target directory.
+func watchDirs(t *testing.T) (string, string, string) {
+	dir, err := ioutil.TempDir("", "gosecret-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(dir, "source")
+	target := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Join(source, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir, source, target
+}
+
+func TestWatchOutputPath(t *testing.T) {
+	dir, source, target := watchDirs(t)
+	defer os.RemoveAll(dir)
+	single := filepath.Join(dir, "single.json")
+	ioutil.WriteFile(single, []byte("{}"), 0644)
+
+	w := &watcher{sources: []string{source, single}, target: target}
+	for file, expected := range map[string]string{
+		filepath.Join(source, "a.json"):        filepath.Join(target, "a.json"),
+		filepath.Join(source, "sub", "b.json"): filepath.Join(target, "sub", "b.json"),
+		single:                                 filepath.Join(target, "single.json"),
+		filepath.Join(source, ".a.json.swp"):   "",
+		filepath.Join(dir, "other.json"):       "",
+	} {
+		output, ok := w.outputPath(file)
+		if output != expected || ok != (expected != "") {
+			t.Errorf("expected %s to map to %q, got %q", file, expected, output)
+		}
+	}
+}
+
+func TestWatchIsKeystorePath(t *testing.T) {
+	w := &watcher{opts: decryptOptions{keystore: "./test_keys" + string(os.PathListSeparator) + "/etc/keys"}}
+	if !w.isKeystorePath("test_keys/myteamkey-2014-09-19") || !w.isKeystorePath("/etc/keys/prod") {
+		t.Error("expected keys in every keystore directory to be keystore paths")
+	}
+	if w.isKeystorePath("test_data/config.json") || w.isKeystorePath("/etc/keys/sub/prod") {
+		t.Error("expected files outside the keystore directories not to be keystore paths")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, _, target := watchDirs(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(target, "sub", "config.json")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if written, err := ioutil.ReadFile(path); err != nil || string(written) != content {
+			t.Errorf("expected %q, got %q: %v", content, written, err)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Errorf("unexpected file mode %v: %v", info.Mode(), err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected temporary files to be removed, found %d files", len(entries))
+	}
+}
+
+func TestWatchCheckTarget(t *testing.T) {
+	dir, source, target := watchDirs(t)
+	defer os.RemoveAll(dir)
+	single := filepath.Join(dir, "single.json")
+	ioutil.WriteFile(single, []byte("{}"), 0644)
+
+	if err := checkTarget(target, []string{source, single + "x"}); err != nil {
+		t.Error(err)
+	}
+	if err := checkTarget(filepath.Join(source, "..", "sourcedecrypted"), []string{source}); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []string{source, filepath.Join(source, "sub", "out"), dir} {
+		if err := checkTarget(bad, []string{source, single}); err == nil {
+			t.Errorf("expected target %s to be rejected", bad)
+		}
+	}
+}
+
+func TestWatchRun(t *testing.T) {
+	dir, source, target := watchDirs(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(source, "a.conf"), []byte("one"), 0644)
+
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	w := &watcher{[]string{source}, target, decryptOptions{keystore: "./test_keys"}, fs}
+	if err := w.watchTree(source); err != nil {
+		t.Fatal(err)
+	}
+	if !w.renderAll() {
+		t.Fatal("expected the initial render to write files")
+	}
+
+	stop := make(chan os.Signal)
+	done := make(chan int)
+	go func() { done <- w.run(10*time.Millisecond, "", stop) }()
+
+	encrypted, err := gosecret.EncryptTags([]byte("[gosecret|b|two]"), "myteamkey-2014-09-19", "./test_keys", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(source, "sub", "b.conf"), encrypted, 0644)
+	ioutil.WriteFile(filepath.Join(source, "a.conf"), []byte("three"), 0644)
+	expected := map[string]string{"a.conf": "three", filepath.Join("sub", "b.conf"): "two"}
+	deadline := time.Now().Add(5 * time.Second)
+	for name, content := range expected {
+		for {
+			written, _ := ioutil.ReadFile(filepath.Join(target, name))
+			if string(written) == content {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s to be decrypted to %q, got %q", name, content, written)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	os.Remove(filepath.Join(source, "a.conf"))
+	for {
+		if _, err := os.Stat(filepath.Join(target, "a.conf")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the decrypted copy of a removed file to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop <- os.Interrupt
+	if status := <-done; status != 0 {
+		t.Errorf("unexpected exit status %d", status)
+	}
+}